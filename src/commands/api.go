@@ -0,0 +1,24 @@
+package commands
+
+import (
+	"log"
+
+	"github.com/gregf/localfm/src/server"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// API runs the read-only JSON API over the database.
+func (env *Env) API(cmd *cobra.Command, args []string) {
+	addr, _ := cmd.Flags().GetString("addr")
+	if addr == "" {
+		addr = viper.GetString("api.addr")
+	}
+	if addr == "" {
+		addr = "localhost:7791"
+	}
+
+	api := server.NewAPI(env.db, env.profile.Name, profileNames())
+	log.Fatal(api.ListenAndServe(addr))
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 
 	"github.com/gregf/localfm/src/database"
+	"github.com/gregf/localfm/src/sources"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -15,19 +16,17 @@ const localFMVersion = "v0.1"
 
 // Env struct
 type Env struct {
-	db database.Datastore
+	db      database.Datastore
+	src     sources.Source
+	profile Profile
 }
 
 // Execute parses command line args and fires up commands
 func Execute() {
 	initConfig()
 
-	db, err := database.NewDB()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	env := &Env{db}
+	sources.UserAgent = fmt.Sprintf("LocalFM %s", localFMVersion)
+	env := &Env{}
 
 	var cmdVersion = &cobra.Command{
 		Use:   "version",
@@ -42,6 +41,20 @@ func Execute() {
 		Short: "Imports all your listened to tracks from lastfm",
 		Run:   env.Import,
 	}
+	cmdImport.Flags().Bool("restart", false, "Ignore any saved checkpoint and start from the oldest page")
+	cmdImport.Flags().Int("from-page", 0, "Start importing at this page and work down to page 1")
+	cmdImport.Flags().Int("concurrency", 0, "Number of pages to fetch at once (defaults to import.concurrency or 4)")
+	cmdImport.Flags().String("file", "", "Import a .csv, .json or .jsonl backup instead of fetching from the source")
+	cmdImport.Flags().StringSlice("spotify", nil, "Import Spotify Extended Streaming History files or the directory holding them")
+	cmdImport.Flags().String("itunes", "", "Import play counts from an iTunes Library.xml")
+	cmdImport.Flags().String("apple-music", "", "Import an Apple Music Play Activity.csv from an Apple data export")
+	cmdImport.Flags().Duration("min-played", 0, "Play time that always counts as a scrobble for --spotify and --apple-music (defaults to import.min_played or 4m)")
+
+	var cmdRepairDates = &cobra.Command{
+		Use:   "repair-dates",
+		Short: "Restore the seconds of track dates stored to the minute by older versions",
+		Run:   env.RepairDates,
+	}
 
 	var cmdDaemon = &cobra.Command{
 		Use:   "daemon",
@@ -54,16 +67,127 @@ func Execute() {
 		Short: "Display statistics about your LocalFM data",
 		Run:   env.Stats,
 	}
+	cmdStats.Flags().StringSlice("compare", nil, "Show these profiles side by side")
+	addRangeFlags(cmdStats)
+
+	var cmdReport = &cobra.Command{
+		Use:   "report <artists|albums|tracks|recent|summary>",
+		Short: "Print statistics as a table, CSV, JSON or Markdown",
+		Run:   env.Report,
+	}
+	cmdReport.Flags().String("format", "table", "Output format: table, csv, json or markdown")
+	cmdReport.Flags().Int("limit", 10, "Number of rows to print, 0 for all")
+	addRangeFlags(cmdReport)
 
-	var rootCmd = &cobra.Command{Use: "localfm"}
+	var cmdExport = &cobra.Command{
+		Use:   "export",
+		Short: "Export every scrobble as CSV, JSON Lines or a Last.fm backup",
+		Run:   env.Export,
+	}
+	cmdExport.Flags().String("format", "csv", "Output format: csv, jsonl, lastfm-csv or lastfm-json")
+	cmdExport.Flags().StringP("output", "o", "", "File to write to instead of stdout")
+	addRangeFlags(cmdExport)
+
+	var cmdServe = &cobra.Command{
+		Use:   "serve",
+		Short: "Receive scrobbles over the Audioscrobbler 2.0 and ListenBrainz APIs",
+		Run:   env.Serve,
+	}
+	cmdServe.Flags().String("addr", "", "Address to listen on (defaults to serve.addr or localhost:7790)")
+
+	var cmdAPI = &cobra.Command{
+		Use:   "api",
+		Short: "Serve your LocalFM data as a read-only JSON API",
+		Run:   env.API,
+	}
+	cmdAPI.Flags().String("addr", "", "Address to listen on (defaults to api.addr or localhost:7791)")
+
+	var cmdDBBackup = &cobra.Command{
+		Use:   "backup [file]",
+		Short: "Back up the database to file, or to a timestamped snapshot",
+		Run:   env.DBBackup,
+	}
+	cmdDBBackup.Flags().String("dir", "", "Directory for snapshots (default backups next to the database)")
+	cmdDBBackup.Flags().Int("keep", 0, "Number of snapshots to keep, 0 keeps all")
+
+	var cmdDB = &cobra.Command{
+		Use:   "db",
+		Short: "Manage the LocalFM database",
+		// The database is opened by each subcommand, without migrating it.
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	}
+	cmdDB.AddCommand(
+		&cobra.Command{
+			Use:   "migrate",
+			Short: "Back up the database and apply pending schema migrations",
+			Run:   env.DBMigrate,
+		},
+		&cobra.Command{
+			Use:   "status",
+			Short: "List schema migrations and whether they have been applied",
+			Run:   env.DBStatus,
+		},
+		cmdDBBackup,
+		&cobra.Command{
+			Use:   "restore <backup>",
+			Short: "Replace the database with a backup",
+			Run:   env.DBRestore,
+		},
+		&cobra.Command{
+			Use:   "check",
+			Short: "Check the database for damage, orphaned tracks and duplicate dates",
+			Run:   env.DBCheck,
+		})
+
+	var rootCmd = &cobra.Command{
+		Use:              "localfm",
+		PersistentPreRun: env.useProfile,
+	}
+	rootCmd.PersistentFlags().String("profile", "", "Config profile to use instead of main.profile")
 	rootCmd.AddCommand(
 		cmdImport,
+		cmdRepairDates,
 		cmdDaemon,
 		cmdStats,
+		cmdReport,
+		cmdExport,
+		cmdServe,
+		cmdAPI,
+		cmdDB,
 		cmdVersion)
 	rootCmd.Execute()
 }
 
+// useProfile opens the database, migrating it if needed, and selects the
+// profile named by --profile and its Source. Tracks stored before profiles
+// existed are handed to the default profile.
+func (env *Env) useProfile(cmd *cobra.Command, args []string) {
+	driver, dsn := databaseConfig()
+	backupDir, _ := backupSettings(nil)
+	db, err := database.NewDB(driver, dsn, backupDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if viper.IsSet("import.merge_window") {
+		db.MergeWindow = viper.GetDuration("import.merge_window")
+	}
+	env.db = db
+
+	name, _ := cmd.Flags().GetString("profile")
+	env.profile = loadProfile(name)
+	env.src = env.profile.newSource()
+
+	if err := env.db.AdoptTracks(defaultProfileName()); err != nil {
+		log.Fatal("Could not assign existing tracks to the default profile:", err)
+	}
+}
+
+// databaseConfig returns the database.driver and database.dsn settings.
+// Left unset, tracks are kept in SQLite in the user's cache directory.
+func databaseConfig() (driver, dsn string) {
+	return viper.GetString("database.driver"), viper.GetString("database.dsn")
+}
+
 func initConfig() {
 	viper.SetConfigName("config")
 	viper.AddConfigPath("/etc/localfm")
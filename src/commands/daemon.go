@@ -1,12 +1,12 @@
 package commands
 
 import (
-	"encoding/xml"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"time"
 
+	"github.com/gregf/localfm/src/sources"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -15,65 +15,75 @@ func (env *Env) Daemon(cmd *cobra.Command, args []string) {
 	ticker := time.NewTicker(1 * time.Minute)
 	fmt.Printf("LocalFM Deamon %s Started\n", localFMVersion)
 	env.Update()
+	// Backups are scheduled from the newest snapshot, so restarting the
+	// daemon neither skips nor repeats one.
+	lastBackup, err := env.db.LastSnapshot(viper.GetString("database.backup_dir"))
+	if err != nil {
+		log.Println("Could not find the last backup:", err)
+	}
 	for _ = range ticker.C {
 		env.Update()
+		if every := viper.GetDuration("daemon.backup_interval"); every > 0 && time.Since(lastBackup) >= every {
+			lastBackup = time.Now()
+			env.scheduledBackup()
+		}
+	}
+}
+
+// scheduledBackup takes a snapshot of the database as configured by
+// database.backup_dir and database.backup_keep. A failed backup is logged
+// rather than stopping the daemon.
+func (env *Env) scheduledBackup() {
+	path, err := env.db.Snapshot(backupSettings(nil))
+	if err != nil {
+		log.Println("Scheduled backup failed:", err)
+		return
 	}
+	fmt.Printf("Backed up database to %s\n", path)
 }
 
+// Update imports the listens made since the newest one stored. A source
+// that stays unreachable after retrying is logged and tried again on the
+// next tick; any other error stops the daemon.
 func (env *Env) Update() {
-	user := viper.GetString("main.lastfm_username")
-	apiKey := viper.GetString("main.lastfm_apikey")
-	epoch, err := env.db.FindLastListen()
+	epoch, err := env.db.FindLastListen(env.profile.Name)
 	if err != nil {
 		log.Fatal("Error parsing time:", err)
 	}
 
-	lastPage, err := TotalPages(baseURL, user, apiKey, limit, epoch)
+	lastPage, _, err := env.src.Totals(epoch)
 	if err != nil {
-		log.Fatal("Could not obtain TotalPages:", err)
+		env.sourceFailed("Could not obtain TotalPages:", err)
+		return
 	}
 	firstPage := 1
 
 	for i := lastPage; i >= firstPage; i-- {
-		url := fmt.Sprintf("%s&api_key=%s&user=%s&page=%d&limit=%d&from=%d", baseURL, apiKey, user, i, limit, epoch)
-
-		resp, err := FetchBody(url)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer resp.Body.Close()
-
-		body, err := ioutil.ReadAll(resp.Body)
+		listens, err := env.src.Page(i, epoch)
 		if err != nil {
-			log.Fatal(err)
+			env.sourceFailed(fmt.Sprintf("Could not fetch page %d:", i), err)
+			return
 		}
 
-		var l LFM
-		err = xml.Unmarshal(body, &l)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		totalItems := (len(l.RecentTracks.Tracks) - 1)
-
-		for i := totalItems; i >= 0; i-- {
-			t := l.RecentTracks.Tracks[i]
-			if t.NowPlaying {
-				return
-			}
-			dt, err := time.Parse("02 Jan 2006, 15:04", t.Date)
+		for _, l := range listens {
+			added, err := env.addListen(l)
 			if err != nil {
-				log.Printf("Error parsing time on %s / %s - %s / %s: %s\n", t.Artist, t.Album, t.Name, t.Date, err)
+				// Later listens are left for the next update, so none
+				// are skipped over.
+				log.Printf("Could not store %s - %s: %s (will retry)\n", l.Artist, l.Title, err)
 				return
 			}
-			if dt.IsZero() {
-				log.Println("Time is Zero")
-				return
-			}
-			env.db.AddArtist(t.Artist)
-			if env.db.AddTrack(t.Artist, t.Album, t.Name, dt) {
-				fmt.Printf("Adding %s / %s - %s.\n", t.Artist, t.Album, t.Name)
+			if added {
+				fmt.Printf("Adding %s / %s - %s.\n", l.Artist, l.Album, l.Title)
 			}
 		}
 	}
 }
+
+// sourceFailed logs err, exiting unless it is temporary.
+func (env *Env) sourceFailed(msg string, err error) {
+	if !sources.Temporary(err) {
+		log.Fatal(msg, " ", env.profile.sourceError(err))
+	}
+	log.Println(msg, env.profile.sourceError(err), "(will retry)")
+}
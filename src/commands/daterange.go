@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gregf/localfm/src/database"
+
+	"github.com/spf13/cobra"
+)
+
+// addRangeFlags adds the --period, --from and --to flags read by rangeFlags.
+func addRangeFlags(cmd *cobra.Command) {
+	cmd.Flags().String("period", "", "Only include 7day, 1month, 3month, 6month, 12month, year:YYYY or month:YYYY-MM")
+	cmd.Flags().String("from", "", "Only include tracks played on or after this date (YYYY-MM-DD, RFC 3339 or unix time)")
+	cmd.Flags().String("to", "", "Only include tracks played before this date (YYYY-MM-DD, RFC 3339 or unix time)")
+}
+
+// rangeFlags returns the date range chosen with --period, --from and --to.
+func rangeFlags(cmd *cobra.Command) (from, to time.Time, err error) {
+	period, _ := cmd.Flags().GetString("period")
+	fromFlag, _ := cmd.Flags().GetString("from")
+	toFlag, _ := cmd.Flags().GetString("to")
+
+	if period != "" && (fromFlag != "" || toFlag != "") {
+		return from, to, fmt.Errorf("--period can not be combined with --from or --to")
+	}
+	if period != "" {
+		return database.ParsePeriod(period, time.Now())
+	}
+
+	if from, err = database.ParseTime(fromFlag); err != nil {
+		return from, to, err
+	}
+	to, err = database.ParseTime(toFlag)
+	return from, to, err
+}
+
+// rangeLabel describes the range chosen with --period, --from and --to.
+func rangeLabel(cmd *cobra.Command) string {
+	period, _ := cmd.Flags().GetString("period")
+	from, _ := cmd.Flags().GetString("from")
+	to, _ := cmd.Flags().GetString("to")
+
+	switch {
+	case period != "":
+		return period
+	case from != "" && to != "":
+		return from + " to " + to
+	case from != "":
+		return "since " + from
+	case to != "":
+		return "before " + to
+	}
+	return ""
+}
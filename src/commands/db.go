@@ -0,0 +1,160 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gregf/localfm/src/database"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// DBMigrate backs up the database and applies any pending migrations.
+func (env *Env) DBMigrate(cmd *cobra.Command, args []string) {
+	db, err := database.Open(databaseConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, _ := backupSettings(nil)
+	backup, err := db.BackupBeforeMigrating(dir)
+	if err != nil {
+		log.Fatal("Could not back up database:", err)
+	}
+	if backup != "" {
+		fmt.Printf("Backed up database to %s\n", backup)
+	}
+
+	n := 0
+	err = db.Migrate(func(m database.Migration) {
+		fmt.Printf("Applying %d: %s\n", m.Version, m.Name)
+		n++
+	})
+	if err != nil {
+		log.Fatal("Migration failed:", err)
+	}
+	if n == 0 {
+		fmt.Println("Database is up to date")
+	}
+}
+
+// DBStatus lists every migration and when it was applied.
+func (env *Env) DBStatus(cmd *cobra.Command, args []string) {
+	db, err := database.Open(databaseConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	status, err := db.Migrations()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Version\tName\tApplied")
+	for _, s := range status {
+		applied := "pending"
+		if s.Applied {
+			applied = s.AppliedAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	tw.Flush()
+}
+
+// DBBackup copies the database to the file named on the command line, or to
+// a timestamped snapshot in --dir, keeping the newest --keep snapshots.
+func (env *Env) DBBackup(cmd *cobra.Command, args []string) {
+	db, err := database.Open(databaseConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(args) == 1 {
+		if err := db.Backup(args[0]); err != nil {
+			log.Fatal("Backup failed:", err)
+		}
+		fmt.Printf("Backed up database to %s\n", args[0])
+		return
+	}
+
+	dir, keep := backupSettings(cmd)
+	path, err := db.Snapshot(dir, keep)
+	if err != nil {
+		log.Fatal("Backup failed:", err)
+	}
+	fmt.Printf("Backed up database to %s\n", path)
+}
+
+// backupSettings returns --dir and --keep, falling back to database.backup_dir
+// and database.backup_keep.
+func backupSettings(cmd *cobra.Command) (dir string, keep int) {
+	dir, keep = viper.GetString("database.backup_dir"), viper.GetInt("database.backup_keep")
+	if cmd != nil {
+		if cmd.Flags().Changed("dir") {
+			dir, _ = cmd.Flags().GetString("dir")
+		}
+		if cmd.Flags().Changed("keep") {
+			keep, _ = cmd.Flags().GetInt("keep")
+		}
+	}
+	return dir, keep
+}
+
+// DBRestore replaces the database with a backup, first taking a snapshot of
+// the database being replaced.
+func (env *Env) DBRestore(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Usage: localfm db restore <backup>")
+	}
+	db, err := database.Open(databaseConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, _ := backupSettings(nil)
+	previous, err := db.Restore(args[0], dir)
+	if previous != "" {
+		fmt.Printf("Backed up current database to %s\n", previous)
+	}
+	if err != nil {
+		log.Fatal("Restore failed:", err)
+	}
+	fmt.Printf("Restored database from %s\n", args[0])
+}
+
+// DBCheck reports damage to the database, tracks linked to missing rows and
+// duplicate dates, exiting with status 1 if it finds any.
+func (env *Env) DBCheck(cmd *cobra.Command, args []string) {
+	db, err := database.Open(databaseConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r, err := db.Check()
+	if err != nil {
+		log.Fatal("Check failed:", err)
+	}
+	if r.OK() {
+		fmt.Println("No problems found")
+		return
+	}
+
+	for _, p := range r.Integrity {
+		fmt.Printf("Integrity: %s\n", p)
+	}
+	for _, column := range []string{"artist_id", "album_id", "song_id"} {
+		if n := r.Orphans[column]; n > 0 {
+			fmt.Printf("Orphaned: %d tracks have a missing %s\n", n, column)
+		}
+	}
+	for _, d := range r.Duplicates {
+		fmt.Printf("Duplicate: profile %s has %d tracks at %s\n",
+			d.Profile, d.Tracks, d.Date.Format(time.RFC3339))
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,219 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gregf/localfm/src/database"
+
+	"github.com/spf13/cobra"
+)
+
+// lastFMPageSize is the number of tracks per page in lastfm-json exports,
+// the most user.getrecenttracks returns.
+const lastFMPageSize = 200
+
+// csvHeader is the first line of a csv export.
+var csvHeader = []string{"artist", "album", "title", "uts", "date", "source", "duration", "artist_mbid", "release_mbid", "recording_mbid", "url", "image_url", "loved", "synthetic"}
+
+// Export writes every track of a profile to a file, oldest first.
+func (env *Env) Export(cmd *cobra.Command, args []string) {
+	format, _ := cmd.Flags().GetString("format")
+	output, _ := cmd.Flags().GetString("output")
+	from, to, err := rangeFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	q := database.Query{Profile: env.profile.Name, From: from, To: to}
+
+	var w io.Writer = os.Stdout
+	if output != "" && output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+
+	switch format {
+	case "csv":
+		err = env.exportCSV(bw, q)
+	case "jsonl":
+		err = env.exportJSONLines(bw, q)
+	case "lastfm-csv":
+		err = env.exportLastFMCSV(bw, q)
+	case "lastfm-json":
+		err = env.exportLastFMJSON(bw, q)
+	default:
+		log.Fatalf("Unknown format %q, expected csv, jsonl, lastfm-csv or lastfm-json", format)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Fatal("Export failed:", err)
+	}
+}
+
+// exportCSV writes one row per track under csvHeader.
+func (env *Env) exportCSV(w io.Writer, q database.Query) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	err := env.db.EachTrack(q, func(t database.Track) error {
+		duration := ""
+		if t.Duration > 0 {
+			duration = fmt.Sprint(t.Duration)
+		}
+		loved, synthetic := "", ""
+		if t.Loved {
+			loved = "true"
+		}
+		if t.Synthetic {
+			synthetic = "true"
+		}
+		return cw.Write([]string{
+			t.Artist,
+			t.Album,
+			t.Title,
+			fmt.Sprint(t.Date.Unix()),
+			t.Date.UTC().Format("2006-01-02T15:04:05Z"),
+			t.Source,
+			duration,
+			t.ArtistMBID,
+			t.ReleaseMBID,
+			t.RecordingMBID,
+			t.URL,
+			t.ImageURL,
+			loved,
+			synthetic,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportJSONLines writes each track as a JSON object on its own line.
+func (env *Env) exportJSONLines(w io.Writer, q database.Query) error {
+	enc := json.NewEncoder(w)
+	return env.db.EachTrack(q, func(t database.Track) error {
+		t.Date = t.Date.UTC()
+		return enc.Encode(t)
+	})
+}
+
+// exportLastFMCSV writes the headerless artist, album, title, date layout of
+// the lastfm-to-csv backup tool.
+func (env *Env) exportLastFMCSV(w io.Writer, q database.Query) error {
+	cw := csv.NewWriter(w)
+	err := env.db.EachTrack(q, func(t database.Track) error {
+		return cw.Write([]string{t.Artist, t.Album, t.Title, t.Date.UTC().Format("02 Jan 2006 15:04")})
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type lastFMText struct {
+	MBID string `json:"mbid"`
+	Text string `json:"#text"`
+}
+
+type lastFMDate struct {
+	UTS  string `json:"uts"`
+	Text string `json:"#text"`
+}
+
+type lastFMTrack struct {
+	Artist lastFMText `json:"artist"`
+	Album  lastFMText `json:"album"`
+	Name   string     `json:"name"`
+	MBID   string     `json:"mbid"`
+	Date   lastFMDate `json:"date"`
+}
+
+type lastFMPage struct {
+	RecentTracks struct {
+		Track []lastFMTrack `json:"track"`
+		Attr  struct {
+			User       string `json:"user"`
+			Page       string `json:"page"`
+			PerPage    string `json:"perPage"`
+			TotalPages string `json:"totalPages"`
+			Total      string `json:"total"`
+		} `json:"@attr"`
+	} `json:"recenttracks"`
+}
+
+// exportLastFMJSON writes a JSON array of pages shaped like the
+// user.getrecenttracks responses saved by Last.fm backup scripts. Pages are
+// built one at a time so only lastFMPageSize tracks are held in memory.
+func (env *Env) exportLastFMJSON(w io.Writer, q database.Query) error {
+	totals, err := env.db.Scrobbles(q)
+	if err != nil {
+		return err
+	}
+	totalPages := (totals.Scrobbles + lastFMPageSize - 1) / lastFMPageSize
+
+	var page lastFMPage
+	n := 0
+	flush := func() error {
+		if len(page.RecentTracks.Track) == 0 {
+			return nil
+		}
+		if n > 0 {
+			fmt.Fprint(w, ",\n")
+		}
+		n++
+		a := &page.RecentTracks.Attr
+		a.User = q.Profile
+		a.Page = fmt.Sprint(n)
+		a.PerPage = fmt.Sprint(lastFMPageSize)
+		a.TotalPages = fmt.Sprint(totalPages)
+		a.Total = fmt.Sprint(totals.Scrobbles)
+		b, err := json.Marshal(page)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		page.RecentTracks.Track = page.RecentTracks.Track[:0]
+		return err
+	}
+
+	fmt.Fprint(w, "[")
+	err = env.db.EachTrack(q, func(t database.Track) error {
+		page.RecentTracks.Track = append(page.RecentTracks.Track, lastFMTrack{
+			Artist: lastFMText{MBID: t.ArtistMBID, Text: t.Artist},
+			Album:  lastFMText{MBID: t.ReleaseMBID, Text: t.Album},
+			Name:   t.Title,
+			MBID:   t.RecordingMBID,
+			Date: lastFMDate{
+				UTS:  fmt.Sprint(t.Date.Unix()),
+				Text: t.Date.UTC().Format("02 Jan 2006, 15:04"),
+			},
+		})
+		if len(page.RecentTracks.Track) == lastFMPageSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(w, "]\n")
+	return err
+}
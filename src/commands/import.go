@@ -1,72 +1,294 @@
 package commands
 
 import (
-	"encoding/xml"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/gregf/localfm/src/database"
+	"github.com/gregf/localfm/src/sources"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 func (env *Env) Import(cmd *cobra.Command, args []string) {
-	user := viper.GetString("main.lastfm_username")
-	apiKey := viper.GetString("main.lastfm_apikey")
+	if path, _ := cmd.Flags().GetString("file"); path != "" {
+		env.importFile(path)
+		return
+	}
+	if paths, _ := cmd.Flags().GetStringSlice("spotify"); len(paths) > 0 {
+		env.importSpotify(cmd, paths)
+		return
+	}
+	if path, _ := cmd.Flags().GetString("itunes"); path != "" {
+		env.importListens(path, func(fn func(sources.Listen) error) error {
+			return sources.ReadITunesLibrary(path, func(t sources.ITunesTrack) error {
+				stored, newest, err := env.db.SourcePlays(env.profile.Name, sources.ITunesSource, t.Artist, t.Title)
+				if err != nil {
+					return err
+				}
+				for _, l := range t.Listens(stored, newest) {
+					if err := fn(l); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+		return
+	}
+	if path, _ := cmd.Flags().GetString("apple-music"); path != "" {
+		minPlayed := minPlayed(cmd)
+		env.importListens(path, func(fn func(sources.Listen) error) error {
+			return sources.ReadAppleMusicActivity(path, minPlayed, fn)
+		})
+		return
+	}
+
+	key := env.profile.Name
 	firstPage := 1
 
-	lastPage, err := TotalPages(baseURL, user, apiKey, limit, 0)
-	if err != nil {
-		log.Fatal("Could not obtain TotalPages:", err)
-	}
+	restart, _ := cmd.Flags().GetBool("restart")
+	fromPage, _ := cmd.Flags().GetInt("from-page")
 
-	totalScrobbles, err := TotalScrobbles(baseURL, user, apiKey, limit, 0)
+	lastPage, totalScrobbles, err := env.src.Totals(0)
 	if err != nil {
-		log.Fatal("Could not obtain Total Scrobbles:", err)
+		log.Fatal("Could not obtain totals: ", env.profile.sourceError(err))
 	}
 
-	n := 1
-	for i := lastPage; i >= firstPage; i-- {
-		url := fmt.Sprintf("%s&api_key=%s&user=%s&page=%d&limit=%d", baseURL, apiKey, user, i, limit)
+	if restart {
+		if err := env.db.ClearCheckpoint(key); err != nil {
+			log.Fatal("Could not clear import checkpoint:", err)
+		}
+	}
 
-		resp, err := FetchBody(url)
-		if err != nil {
-			log.Fatal(err)
+	startPage := lastPage
+	cp, resuming := env.db.Checkpoint(key)
+	if resuming && (cp.Username != env.profile.Username || cp.Endpoint != env.src.Endpoint()) {
+		// The page numbers were for another account's scrobbles.
+		fmt.Printf("Discarding the import checkpoint saved for %q at %s\n", cp.Username, cp.Endpoint)
+		if err := env.db.ClearCheckpoint(key); err != nil {
+			log.Fatal("Could not clear import checkpoint:", err)
 		}
+		resuming = false
+	}
+	switch {
+	case fromPage > 0:
+		startPage = fromPage
+	case resuming:
+		startPage = resumePage(cp, totalScrobbles, env.src.Limit())
+		fmt.Printf("Resuming import at page %d\n", startPage)
+	}
+	if startPage > lastPage {
+		startPage = lastPage
+	}
+	if !resuming || fromPage > 0 {
+		cp = database.ImportCheckpoint{Profile: key}
+	}
+	cp.Username = env.profile.Username
+	cp.Endpoint = env.src.Endpoint()
+	cp.Limit = env.src.Limit()
+	cp.Total = totalScrobbles
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatal(err)
+	n := 1
+	for page := range env.fetchPages(startPage, firstPage, concurrency(cmd)) {
+		if page.err != nil {
+			log.Fatalf("Import stopped on page %d: %s (run import again to resume)", page.number, env.profile.sourceError(page.err))
 		}
-		defer resp.Body.Close()
 
-		var l LFM
-		err = xml.Unmarshal(body, &l)
+		err := env.db.Transaction(func(tx database.Datastore) error {
+			for _, l := range page.listens {
+				added, err := env.storeListen(tx, l)
+				if err != nil {
+					return err
+				}
+				if added {
+					fmt.Printf("\033[H\033[2J%d/%d %s / %s - %s", n, totalScrobbles, l.Artist, l.Album, l.Title)
+					n++
+				}
+			}
+			cp.Page = page.number
+			return tx.SaveCheckpoint(cp)
+		})
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Could not store page %d: %s (run import again to resume)", page.number, err)
 		}
+	}
 
-		totalItems := (len(l.RecentTracks.Tracks) - 1)
-		for i := totalItems; i >= 0; i-- {
-			t := l.RecentTracks.Tracks[i]
-			if t.NowPlaying {
-				continue
-			}
-			dt, err := time.Parse("02 Jan 2006, 15:04", t.Date)
-			if err != nil {
-				log.Printf("Error parsing time on %s / %s - %s / %s: %s\n", t.Artist, t.Album, t.Name, t.Date, err)
-				continue
+	if err := env.db.ClearCheckpoint(key); err != nil {
+		log.Fatal("Could not clear import checkpoint:", err)
+	}
+}
+
+// fetchedPage is a page of listens, or the error fetching it failed with.
+type fetchedPage struct {
+	number  int
+	listens []sources.Listen
+	err     error
+}
+
+// fetchPages fetches pages from down to to, up to workers at a time, and
+// sends them on the returned channel in that order. No more than workers
+// pages are fetched ahead of the one being read. Sources that are not a
+// sources.ConcurrentSource are fetched from one page at a time. A page that
+// failed is the last sent.
+func (env *Env) fetchPages(from, to, workers int) <-chan fetchedPage {
+	if workers < 1 || !sources.Concurrent(env.src) {
+		workers = 1
+	}
+	pending := make(chan chan fetchedPage, workers-1)
+	stop := make(chan struct{})
+	go func() {
+		defer close(pending)
+		for i := from; i >= to; i-- {
+			c := make(chan fetchedPage, 1)
+			select {
+			case pending <- c:
+			case <-stop:
+				return
 			}
-			if dt.IsZero() {
-				log.Println("Time is Zero")
-				continue
+			go func(i int) {
+				listens, err := env.src.Page(i, 0)
+				c <- fetchedPage{number: i, listens: listens, err: err}
+			}(i)
+		}
+	}()
+
+	pages := make(chan fetchedPage)
+	go func() {
+		defer close(pages)
+		defer close(stop)
+		for c := range pending {
+			page := <-c
+			pages <- page
+			if page.err != nil {
+				return
 			}
-			env.db.AddArtist(t.Artist)
-			if env.db.AddTrack(t.Artist, t.Album, t.Name, dt) {
-				fmt.Printf("\033[H\033[2J%d/%d %s / %s - %s", n, totalScrobbles, t.Artist, t.Album, t.Name)
-				n++
+		}
+	}()
+	return pages
+}
+
+// concurrency returns --concurrency, falling back to import.concurrency and
+// then 4. The Last.fm rate limit applies however many pages are fetched at
+// once, and sources that can not be read in parallel ignore it.
+func concurrency(cmd *cobra.Command) int {
+	n, _ := cmd.Flags().GetInt("concurrency")
+	if n == 0 {
+		n = viper.GetInt("import.concurrency")
+	}
+	if n == 0 {
+		n = 4
+	}
+	return n
+}
+
+// importFile stores the listens in the backup at path. Listens already in
+// the database are skipped, so the same backup can be imported again.
+func (env *Env) importFile(path string) {
+	source := "file://" + path
+	if abs, err := filepath.Abs(path); err == nil {
+		source = "file://" + abs
+	}
+	env.importListens(path, func(fn func(sources.Listen) error) error {
+		return sources.ReadFile(path, func(l sources.Listen) error {
+			if l.Source == "" {
+				l.Source = source
 			}
+			return fn(l)
+		})
+	})
+}
+
+// importSpotify stores the plays in a Spotify Extended Streaming History
+// export that count as scrobbles.
+func (env *Env) importSpotify(cmd *cobra.Command, paths []string) {
+	h, err := sources.NewSpotifyHistory(paths, minPlayed(cmd))
+	if err != nil {
+		log.Fatal("Could not read Spotify history:", err)
+	}
+	if len(h.Files) == 0 {
+		log.Fatal("No Streaming_History_Audio files found in ", strings.Join(paths, ", "))
+	}
+	env.importListens("Spotify history", h.Each)
+}
+
+// minPlayed returns the play time that always counts as a scrobble, from
+// --min-played or the import.min_played setting. Zero leaves it to the
+// importer's default.
+func minPlayed(cmd *cobra.Command) time.Duration {
+	d, _ := cmd.Flags().GetDuration("min-played")
+	if d == 0 {
+		d = viper.GetDuration("import.min_played")
+	}
+	return d
+}
+
+// importListens stores every listen each passes to its callback, printing
+// progress. Listens already in the database are skipped.
+func (env *Env) importListens(name string, each func(func(sources.Listen) error) error) {
+	read, added := 0, 0
+	err := each(func(l sources.Listen) error {
+		read++
+		new, err := env.addListen(l)
+		if err != nil {
+			return err
+		}
+		if new {
+			added++
 		}
+		if read%1000 == 0 {
+			fmt.Printf("\033[H\033[2J%d read, %d new", read, added)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Import of %s stopped after %d scrobbles: %s", name, read, err)
+	}
+	fmt.Printf("Imported %d new of %d scrobbles from %s\n", added, read, name)
+}
+
+// addListen stores l, reporting whether it was new. Listens that do not say
+// where they were recorded are credited to the profile's Source.
+func (env *Env) addListen(l sources.Listen) (bool, error) {
+	return env.storeListen(env.db, l)
+}
+
+// storeListen is addListen writing to db, which may be a transaction.
+func (env *Env) storeListen(db database.Datastore, l sources.Listen) (bool, error) {
+	source := l.Source
+	if source == "" {
+		source = env.src.Endpoint()
+	}
+	return db.AddTrack(database.Track{
+		Profile:       env.profile.Name,
+		Artist:        l.Artist,
+		Album:         l.Album,
+		Title:         l.Title,
+		Date:          l.Date,
+		Source:        source,
+		Duration:      l.Duration,
+		ArtistMBID:    l.ArtistMBID,
+		ReleaseMBID:   l.ReleaseMBID,
+		RecordingMBID: l.RecordingMBID,
+		URL:           l.URL,
+		ImageURL:      l.ImageURL,
+		Loved:         l.Loved,
+		Synthetic:     l.Synthetic,
+	})
+}
+
+// resumePage works out which page to continue from after cp. Scrobbles made
+// since the checkpoint push older tracks onto later pages, so the page number
+// is shifted by the growth in total to avoid leaving a gap.
+func resumePage(cp database.ImportCheckpoint, total, limit int) int {
+	done := (cp.Page - 1) * cp.Limit
+	grown := total - cp.Total
+	if grown < 0 {
+		grown = 0
 	}
+	return (done + grown + limit - 1) / limit
 }
@@ -0,0 +1,208 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gregf/localfm/src/sources"
+)
+
+// pagedSource serves pages numbered 1 to pages, taking longer over higher
+// numbers so they finish out of order, and failing on page fail.
+type pagedSource struct {
+	pages, fail int
+
+	mu      sync.Mutex
+	fetched []int
+}
+
+func (s *pagedSource) Name() string     { return "test" }
+func (s *pagedSource) Endpoint() string { return "test" }
+func (s *pagedSource) Limit() int       { return 1 }
+
+func (s *pagedSource) ConcurrentPages() bool { return true }
+
+func (s *pagedSource) Totals(since int64) (int, int, error) {
+	return s.pages, s.pages, nil
+}
+
+func (s *pagedSource) Page(page int, since int64) ([]sources.Listen, error) {
+	time.Sleep(time.Duration(page) * time.Millisecond)
+	s.mu.Lock()
+	s.fetched = append(s.fetched, page)
+	s.mu.Unlock()
+	if page == s.fail {
+		return nil, errors.New("page failed")
+	}
+	return []sources.Listen{{Title: string(rune('a' + page))}}, nil
+}
+
+// cursorSource reads pages through a cursor that only moves one page on, as
+// APIs paging by timestamp do, so it can not serve two pages at once.
+type cursorSource struct {
+	pages int
+
+	mu       sync.Mutex
+	inFlight int
+	next     int
+}
+
+func (s *cursorSource) Name() string     { return "test" }
+func (s *cursorSource) Endpoint() string { return "test" }
+func (s *cursorSource) Limit() int       { return 1 }
+
+func (s *cursorSource) Totals(since int64) (int, int, error) {
+	return s.pages, s.pages, nil
+}
+
+func (s *cursorSource) Page(page int, since int64) ([]sources.Listen, error) {
+	s.mu.Lock()
+	s.inFlight++
+	busy := s.inFlight > 1
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	if busy {
+		return nil, fmt.Errorf("page %d fetched while another was", page)
+	}
+
+	time.Sleep(time.Millisecond)
+	if s.next == 0 {
+		s.next = s.pages
+	}
+	if page != s.next {
+		return nil, fmt.Errorf("page %d fetched when the cursor is at %d", page, s.next)
+	}
+	s.next--
+	return []sources.Listen{{Title: strconv.Itoa(page)}}, nil
+}
+
+func TestFetchPagesOneAtATime(t *testing.T) {
+	env := &Env{src: &cursorSource{pages: 20}}
+
+	want := 20
+	for page := range env.fetchPages(20, 1, 4) {
+		if page.err != nil {
+			t.Fatal(page.err)
+		}
+		if page.number != want {
+			t.Fatalf("got page %d, want %d", page.number, want)
+		}
+		want--
+	}
+	if want != 0 {
+		t.Errorf("stopped before page %d", want)
+	}
+}
+
+func TestFetchPagesInOrder(t *testing.T) {
+	src := &pagedSource{pages: 20}
+	env := &Env{src: src}
+
+	want := 20
+	for page := range env.fetchPages(20, 1, 4) {
+		if page.err != nil {
+			t.Fatal(page.err)
+		}
+		if page.number != want {
+			t.Fatalf("got page %d, want %d", page.number, want)
+		}
+		if len(page.listens) != 1 || page.listens[0].Title != string(rune('a'+want)) {
+			t.Fatalf("page %d holds %v", page.number, page.listens)
+		}
+		want--
+	}
+	if want != 0 {
+		t.Errorf("stopped before page %d", want)
+	}
+}
+
+func TestFetchPagesStopsAtError(t *testing.T) {
+	src := &pagedSource{pages: 20, fail: 15}
+	env := &Env{src: src}
+
+	var got []int
+	for page := range env.fetchPages(20, 1, 4) {
+		got = append(got, page.number)
+		if page.number == 15 && page.err == nil {
+			t.Error("page 15 did not fail")
+		}
+	}
+	if len(got) != 6 || got[0] != 20 || got[5] != 15 {
+		t.Errorf("got pages %v, want 20 down to 15", got)
+	}
+
+	// Only the pages already started when page 15 failed are fetched.
+	time.Sleep(50 * time.Millisecond)
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if len(src.fetched) > 6+4 {
+		t.Errorf("fetched %d pages after page 15 failed", len(src.fetched)-6)
+	}
+}
+
+// listenBrainzServer serves n listens, one a second, through the
+// ListenBrainz listen-count and listens endpoints.
+func listenBrainzServer(n int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1/user/alice/listen-count" {
+			fmt.Fprintf(w, `{"payload":{"count":%d}}`, n)
+			return
+		}
+		minTs, _ := strconv.Atoi(r.URL.Query().Get("min_ts"))
+		count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+		first := minTs + 1
+		last := first + count - 1
+		if last > n {
+			last = n
+		}
+		// Newest first, as ListenBrainz returns them.
+		listens := []map[string]interface{}{}
+		for ts := last; ts >= first; ts-- {
+			listens = append(listens, map[string]interface{}{
+				"listened_at":    ts,
+				"track_metadata": map[string]string{"artist_name": "A", "track_name": strconv.Itoa(ts)},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"payload": map[string]interface{}{"count": len(listens), "listens": listens},
+		})
+	}))
+}
+
+func TestFetchPagesFromListenBrainz(t *testing.T) {
+	srv := listenBrainzServer(1000)
+	defer srv.Close()
+
+	env := &Env{src: sources.NewListenBrainz(srv.URL, "alice", "")}
+	pages, _, err := env.src.Totals(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for page := range env.fetchPages(pages, 1, 4) {
+		if page.err != nil {
+			t.Fatal(page.err)
+		}
+		for _, l := range page.listens {
+			n++
+			if l.Title != strconv.Itoa(n) {
+				t.Fatalf("listen %d is %s", n, l.Title)
+			}
+		}
+	}
+	if n != 1000 {
+		t.Errorf("fetched %d listens, want 1000", n)
+	}
+}
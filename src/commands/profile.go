@@ -0,0 +1,141 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/gregf/localfm/src/sources"
+
+	"github.com/spf13/viper"
+)
+
+// defaultProfile is the name given to the account configured by the main
+// section, for configs written before profiles existed.
+const defaultProfile = "default"
+
+// Profile is a named listener account from the profiles section of the
+// config. Tracks imported through a profile are stored under its name.
+type Profile struct {
+	Name     string
+	Source   string
+	Username string
+	APIKey   string
+	URL      string
+	Token    string
+
+	// Password lets music players log in to the scrobble server as this
+	// profile, and ListenToken lets ListenBrainz clients submit to it. With
+	// Forward set, received scrobbles are also sent on to the Last.fm
+	// compatible server at URL, signed with Secret and SessionKey.
+	Password    string
+	ListenToken string
+	Forward     bool
+	Secret      string
+	SessionKey  string
+}
+
+// defaultProfileName returns main.profile, or "default" when it is not set.
+func defaultProfileName() string {
+	if name := viper.GetString("main.profile"); name != "" {
+		return name
+	}
+	return defaultProfile
+}
+
+// loadProfile reads the named profile from the config. An empty name selects
+// the default profile.
+func loadProfile(name string) Profile {
+	if name == "" {
+		name = defaultProfileName()
+	}
+
+	key := "profiles." + name
+	if viper.Get(key) != nil {
+		return Profile{
+			Name:     name,
+			Source:   viper.GetString(key + ".source"),
+			Username: viper.GetString(key + ".username"),
+			APIKey:   viper.GetString(key + ".apikey"),
+			URL:      viper.GetString(key + ".url"),
+			Token:    viper.GetString(key + ".token"),
+
+			Password:    viper.GetString(key + ".password"),
+			ListenToken: viper.GetString(key + ".listen_token"),
+			Forward:     viper.GetBool(key + ".forward"),
+			Secret:      viper.GetString(key + ".secret"),
+			SessionKey:  viper.GetString(key + ".session_key"),
+		}
+	}
+
+	if name != defaultProfile {
+		log.Fatalf("Unknown profile %q", name)
+	}
+
+	p := Profile{
+		Name:        name,
+		Source:      viper.GetString("main.source"),
+		Password:    viper.GetString("main.password"),
+		ListenToken: viper.GetString("main.listen_token"),
+		Forward:     viper.GetBool("main.forward"),
+		Secret:      viper.GetString("main.lastfm_secret"),
+		SessionKey:  viper.GetString("main.lastfm_session_key"),
+	}
+	if p.Source == "listenbrainz" {
+		p.Username = viper.GetString("listenbrainz.username")
+		p.URL = viper.GetString("listenbrainz.url")
+		p.Token = viper.GetString("listenbrainz.token")
+	} else {
+		p.Username = viper.GetString("main.lastfm_username")
+		p.APIKey = viper.GetString("main.lastfm_apikey")
+		p.URL = viper.GetString("main.lastfm_url")
+	}
+	return p
+}
+
+// profileNames returns the names of every configured profile.
+func profileNames() []string {
+	var names []string
+	for name := range viper.GetStringMap("profiles") {
+		names = append(names, name)
+	}
+	if viper.Get("profiles."+defaultProfile) == nil && viper.GetString("main.profile") == "" {
+		names = append(names, defaultProfile)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newSource returns the Source listens for p are imported from. Last.fm is
+// used when p.Source is not set, and p.URL points it at another Last.fm
+// compatible server.
+func (p Profile) newSource() sources.Source {
+	switch p.Source {
+	case "", "lastfm":
+		return sources.NewLastFM(p.URL, p.Username, p.APIKey)
+	case "listenbrainz":
+		return sources.NewListenBrainz(p.URL, p.Username, p.Token)
+	default:
+		log.Fatalf("Unknown source %q in profile %q", p.Source, p.Name)
+	}
+	return nil
+}
+
+// sourceError explains err from p's Source, pointing at the setting to fix
+// when Last.fm rejected the account.
+func (p Profile) sourceError(err error) string {
+	switch {
+	case errors.Is(err, sources.ErrInvalidAPIKey):
+		return fmt.Sprintf("Last.fm rejected the API key of profile %q, check its apikey setting (%s)", p.Name, err)
+	case errors.Is(err, sources.ErrUserNotFound):
+		return fmt.Sprintf("Last.fm has no user %q, check the username of profile %q (%s)", p.Username, p.Name, err)
+	case errors.Is(err, sources.ErrInvalidParameters):
+		return fmt.Sprintf("Last.fm rejected a request for profile %q as invalid, check its settings (%s)", p.Name, err)
+	case errors.Is(err, sources.ErrRateLimited):
+		return fmt.Sprintf("Last.fm is limiting requests, try again later (%s)", err)
+	case errors.Is(err, sources.ErrServiceOffline):
+		return fmt.Sprintf("Last.fm is offline, try again later (%s)", err)
+	}
+	return err.Error()
+}
@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/gregf/localfm/src/database"
+
+	"github.com/spf13/cobra"
+)
+
+// RepairDates walks every page of the profile's Source and corrects tracks
+// that were stored with the minute-resolution date Last.fm displays instead
+// of the exact timestamp it sends alongside it.
+func (env *Env) RepairDates(cmd *cobra.Command, args []string) {
+	lastPage, _, err := env.src.Totals(0)
+	if err != nil {
+		log.Fatal("Could not obtain totals: ", env.profile.sourceError(err))
+	}
+
+	fixed := 0
+	for i := lastPage; i >= 1; i-- {
+		listens, err := env.src.Page(i, 0)
+		if err != nil {
+			log.Fatalf("Repair stopped on page %d: %s", i, env.profile.sourceError(err))
+		}
+
+		for _, l := range listens {
+			ok, err := env.db.RepairDate(database.Track{
+				Profile: env.profile.Name,
+				Artist:  l.Artist,
+				Title:   l.Title,
+				Date:    l.Date,
+			})
+			if err != nil {
+				log.Fatalf("Could not repair %s - %s: %s", l.Artist, l.Title, err)
+			}
+			if ok {
+				fixed++
+			}
+		}
+		fmt.Printf("\033[H\033[2JPage %d/%d, %d dates corrected", lastPage-i+1, lastPage, fixed)
+	}
+	fmt.Printf("\nCorrected %d dates\n", fixed)
+}
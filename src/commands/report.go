@@ -0,0 +1,182 @@
+package commands
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gregf/localfm/src/database"
+
+	"github.com/spf13/cobra"
+)
+
+// report is a statistic ready to be written in any of the report formats.
+// Rows feed the table, csv and markdown formats and value the json one.
+type report struct {
+	header []string
+	rows   [][]string
+	value  interface{}
+}
+
+// Report prints one of the statistics shown by stats in a format that can be
+// piped or pasted.
+func (env *Env) Report(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Usage: localfm report <artists|albums|tracks|recent|summary>")
+	}
+
+	format, _ := cmd.Flags().GetString("format")
+	limit, _ := cmd.Flags().GetInt("limit")
+	from, to, err := rangeFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	q := database.Query{
+		Profile: env.profile.Name,
+		From:    from,
+		To:      to,
+		Limit:   limit,
+	}
+
+	r, err := env.buildReport(args[0], q)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch format {
+	case "table":
+		err = r.writeTable(os.Stdout)
+	case "csv":
+		err = r.writeCSV(os.Stdout)
+	case "json":
+		err = r.writeJSON(os.Stdout)
+	case "markdown":
+		err = r.writeMarkdown(os.Stdout)
+	default:
+		log.Fatalf("Unknown format %q, expected table, csv, json or markdown", format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// buildReport runs the query behind the named report.
+func (env *Env) buildReport(name string, q database.Query) (r report, err error) {
+	switch name {
+	case "artists":
+		counts, err := env.db.TopArtists(q)
+		if err != nil {
+			return r, err
+		}
+		r.header = []string{"Rank", "Artist", "Plays"}
+		for i, c := range counts {
+			r.rows = append(r.rows, []string{fmt.Sprint(i + 1), c.Name, fmt.Sprint(c.Plays)})
+		}
+		r.value = counts
+	case "albums":
+		counts, err := env.db.TopAlbums(q)
+		if err != nil {
+			return r, err
+		}
+		r.header = []string{"Rank", "Artist", "Album", "Plays"}
+		for i, c := range counts {
+			r.rows = append(r.rows, []string{fmt.Sprint(i + 1), c.Artist, c.Album, fmt.Sprint(c.Plays)})
+		}
+		r.value = counts
+	case "tracks":
+		counts, err := env.db.TopSongs(q)
+		if err != nil {
+			return r, err
+		}
+		r.header = []string{"Rank", "Artist", "Title", "Plays"}
+		for i, c := range counts {
+			r.rows = append(r.rows, []string{fmt.Sprint(i + 1), c.Artist, c.Title, fmt.Sprint(c.Plays)})
+		}
+		r.value = counts
+	case "recent":
+		tracks, err := env.db.RecentTracks(q)
+		if err != nil {
+			return r, err
+		}
+		r.header = []string{"Date", "Artist", "Album", "Title"}
+		for _, t := range tracks {
+			r.rows = append(r.rows, []string{t.Date.Format("2006-01-02 15:04"), t.Artist, t.Album, t.Title})
+		}
+		r.value = tracks
+	case "summary":
+		t, err := env.db.Scrobbles(q)
+		if err != nil {
+			return r, err
+		}
+		r.header = []string{"Profile", "Scrobbles", "Artists", "Albums", "Songs", "First played", "Last played"}
+		r.rows = [][]string{{
+			q.Profile,
+			fmt.Sprint(t.Scrobbles),
+			fmt.Sprint(t.Artists),
+			fmt.Sprint(t.Albums),
+			fmt.Sprint(t.Songs),
+			formatDate(t.FirstPlayed),
+			formatDate(t.LastPlayed),
+		}}
+		r.value = t
+	default:
+		return r, fmt.Errorf("unknown report %q, expected artists, albums, tracks, recent or summary", name)
+	}
+	return r, nil
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func (r report) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(r.header, "\t"))
+	for _, row := range r.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (r report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(r.header)
+	cw.WriteAll(r.rows)
+	return cw.Error()
+}
+
+func (r report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.value)
+}
+
+func (r report) writeMarkdown(w io.Writer) error {
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+	line := func(cells []string) {
+		for i, c := range cells {
+			cells[i] = escape.Replace(c)
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+	}
+
+	line(append([]string(nil), r.header...))
+	sep := make([]string, len(r.header))
+	for i := range sep {
+		sep[i] = "---"
+	}
+	fmt.Fprintf(w, "|%s|\n", strings.Join(sep, "|"))
+	for _, row := range r.rows {
+		line(row)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package commands
+
+import (
+	"log"
+
+	"github.com/gregf/localfm/src/server"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Serve runs the scrobble server. Every profile with a password or listen
+// token can be scrobbled to.
+func (env *Env) Serve(cmd *cobra.Command, args []string) {
+	addr, _ := cmd.Flags().GetString("addr")
+	if addr == "" {
+		addr = viper.GetString("serve.addr")
+	}
+	if addr == "" {
+		addr = "localhost:7790"
+	}
+
+	var accounts []server.Account
+	for _, name := range profileNames() {
+		p := loadProfile(name)
+		if p.Password == "" && p.ListenToken == "" {
+			continue
+		}
+		acct := server.Account{
+			Profile:  p.Name,
+			Password: p.Password,
+			Token:    p.ListenToken,
+		}
+		if p.Forward {
+			acct.Forward = &server.Forwarder{
+				URL:        p.URL,
+				APIKey:     p.APIKey,
+				Secret:     p.Secret,
+				SessionKey: p.SessionKey,
+			}
+		}
+		accounts = append(accounts, acct)
+	}
+	if len(accounts) == 0 {
+		log.Fatal("No profiles have a password or listen token to scrobble with")
+	}
+
+	log.Fatal(server.NewServer(env.db, accounts).ListenAndServe(addr))
+}
@@ -1,69 +1,45 @@
 package commands
 
 import (
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/gregf/localfm/src/database"
+
+	"github.com/dustin/go-humanize"
 	ui "github.com/gizak/termui"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 func (env *Env) Stats(cmd *cobra.Command, args []string) {
-	err := ui.Init()
+	from, to, err := rangeFlags(cmd)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	defer ui.Close()
-
-	ui.UseTheme("helloworld")
-
-	s := ui.NewPar(env.db.Scrobbles())
-	s.Border.Label = "LocalFM"
-	s.Height = 3
-
-	recTracks, err := env.db.RecentTracks()
-	if err != nil {
-		log.Fatalf("Error in RecentTracks:", err)
+	q := database.Query{From: from, To: to}
+	label := "LocalFM"
+	if r := rangeLabel(cmd); r != "" {
+		label = fmt.Sprintf("LocalFM (%s)", r)
 	}
-	rec := ui.NewPar(recTracks)
-	rec.Border.Label = "Recent Tracks"
-	rec.Height = (viper.GetInt("main.recent_tracks") + 2)
 
-	topArtists, err := env.db.TopArtists()
+	err = ui.Init()
 	if err != nil {
-		log.Fatalf("Error in TopArtists:", err)
+		panic(err)
 	}
-	topart := ui.NewPar(topArtists)
-	topart.Border.Label = "Top Artists"
-	topart.Height = (viper.GetInt("main.top_artists") + 2)
+	defer ui.Close()
 
-	topAlbums, err := env.db.TopAlbums()
-	if err != nil {
-		log.Fatalf("Error in TopAlbums:", err)
-	}
-	topalbs := ui.NewPar(topAlbums)
-	topalbs.Border.Label = "Top Albums"
-	topalbs.Height = (viper.GetInt("main.top_albums") + 2)
+	ui.UseTheme("helloworld")
 
-	topSongs, err := env.db.TopSongs()
-	if err != nil {
-		log.Fatalf("Error in TopSongs:", err)
+	compare, _ := cmd.Flags().GetStringSlice("compare")
+	if len(compare) > 0 {
+		ui.Body.AddRows(env.compareRows(q, label, compare)...)
+	} else {
+		q.Profile = env.profile.Name
+		ui.Body.AddRows(env.profileRows(q, label)...)
 	}
-	topsongs := ui.NewPar(topSongs)
-	topsongs.Border.Label = "Top Songs"
-	topsongs.Height = (viper.GetInt("main.top_songs") + 2)
-
-	ui.Body.AddRows(
-		ui.NewRow(
-			ui.NewCol(12, 0, s)),
-		ui.NewRow(
-			ui.NewCol(12, 0, rec)),
-		ui.NewRow(
-			ui.NewCol(6, 0, topart),
-			ui.NewCol(6, 0, topalbs)),
-		ui.NewRow(
-			ui.NewCol(12, 0, topsongs)))
 
 	ui.Body.Align()
 
@@ -98,3 +74,157 @@ func (env *Env) Stats(cmd *cobra.Command, args []string) {
 		}
 	}
 }
+
+// profileRows lays out the full dashboard for q's profile.
+func (env *Env) profileRows(q database.Query, label string) []*ui.Row {
+	p := env.panels(q, label)
+	return []*ui.Row{
+		ui.NewRow(
+			ui.NewCol(12, 0, p.scrobbles)),
+		ui.NewRow(
+			ui.NewCol(12, 0, p.recent)),
+		ui.NewRow(
+			ui.NewCol(6, 0, p.artists),
+			ui.NewCol(6, 0, p.albums)),
+		ui.NewRow(
+			ui.NewCol(12, 0, p.songs)),
+	}
+}
+
+// compareRows lays out profiles side by side, one column each.
+func (env *Env) compareRows(q database.Query, label string, profiles []string) []*ui.Row {
+	span := 12 / len(profiles)
+	if span == 0 {
+		log.Fatal("Can not compare more than 12 profiles")
+	}
+
+	var scrobbles, artists, albums, songs []*ui.Row
+	for _, profile := range profiles {
+		q.Profile = profile
+		p := env.panels(q, label)
+		scrobbles = append(scrobbles, ui.NewCol(span, 0, p.scrobbles))
+		artists = append(artists, ui.NewCol(span, 0, p.artists))
+		albums = append(albums, ui.NewCol(span, 0, p.albums))
+		songs = append(songs, ui.NewCol(span, 0, p.songs))
+	}
+
+	return []*ui.Row{
+		ui.NewRow(scrobbles...),
+		ui.NewRow(artists...),
+		ui.NewRow(albums...),
+		ui.NewRow(songs...),
+	}
+}
+
+type statsPanels struct {
+	scrobbles *ui.Par
+	recent    *ui.Par
+	artists   *ui.Par
+	albums    *ui.Par
+	songs     *ui.Par
+}
+
+// panels builds the stats widgets for the tracks matched by q, labelling
+// the summary with label.
+func (env *Env) panels(q database.Query, label string) (p statsPanels) {
+	totals, err := env.db.Scrobbles(q)
+	if err != nil {
+		log.Fatal("Error in Scrobbles:", err)
+	}
+	p.scrobbles = ui.NewPar(formatTotals(q.Profile, totals))
+	p.scrobbles.Border.Label = label
+	p.scrobbles.Height = 3
+
+	q.Limit = panelRows("main.recent_tracks")
+	recTracks, err := env.db.RecentTracks(q)
+	if err != nil {
+		log.Fatal("Error in RecentTracks:", err)
+	}
+	p.recent = ui.NewPar(formatRecent(recTracks))
+	p.recent.Border.Label = "Recent Tracks"
+	p.recent.Height = q.Limit + 2
+
+	q.Limit = panelRows("main.top_artists")
+	topArtists, err := env.db.TopArtists(q)
+	if err != nil {
+		log.Fatal("Error in TopArtists:", err)
+	}
+	p.artists = ui.NewPar(formatArtists(topArtists))
+	p.artists.Border.Label = "Top Artists"
+	p.artists.Height = q.Limit + 2
+
+	q.Limit = panelRows("main.top_albums")
+	topAlbums, err := env.db.TopAlbums(q)
+	if err != nil {
+		log.Fatal("Error in TopAlbums:", err)
+	}
+	p.albums = ui.NewPar(formatAlbums(topAlbums))
+	p.albums.Border.Label = "Top Albums"
+	p.albums.Height = q.Limit + 2
+
+	q.Limit = panelRows("main.top_songs")
+	topSongs, err := env.db.TopSongs(q)
+	if err != nil {
+		log.Fatal("Error in TopSongs:", err)
+	}
+	p.songs = ui.NewPar(formatSongs(topSongs))
+	p.songs.Border.Label = "Top Songs"
+	p.songs.Height = q.Limit + 2
+
+	return p
+}
+
+// defaultPanelRows is how many rows a stats panel shows when its setting is
+// missing or not positive.
+const defaultPanelRows = 10
+
+// panelRows returns the number of rows setting asks a panel to show, falling
+// back to defaultPanelRows. A limit of 0 would load every row.
+func panelRows(setting string) int {
+	if n := viper.GetInt(setting); n > 0 {
+		return n
+	}
+	return defaultPanelRows
+}
+
+// formatTotals returns a line with the profile name, number of scrobbles,
+// artists, and the first play date.
+func formatTotals(profile string, t database.Totals) string {
+	return fmt.Sprintf("%s     Scrobbles: %s     Artists: %s     Since: %s",
+		profile,
+		humanize.Comma(int64(t.Scrobbles)),
+		humanize.Comma(int64(t.Artists)),
+		t.FirstPlayed.Format("02 Jan 2006"))
+}
+
+func formatRecent(tracks []database.Track) string {
+	var str []string
+	for _, t := range tracks {
+		str = append(str, fmt.Sprintf("%s - %s %s", t.Artist, t.Title, humanize.Time(t.Date)))
+	}
+	return strings.Join(str, "\n")
+}
+
+func formatArtists(counts []database.ArtistCount) string {
+	var str []string
+	for _, c := range counts {
+		str = append(str, fmt.Sprintf("%s (%d plays)", c.Name, c.Plays))
+	}
+	return strings.Join(str, "\n")
+}
+
+func formatAlbums(counts []database.AlbumCount) string {
+	var str []string
+	for _, c := range counts {
+		str = append(str, fmt.Sprintf("%s - %s (%d plays)", c.Artist, c.Album, c.Plays))
+	}
+	return strings.Join(str, "\n")
+}
+
+func formatSongs(counts []database.SongCount) string {
+	var str []string
+	for _, c := range counts {
+		str = append(str, fmt.Sprintf("%s - %s (%d plays)", c.Artist, c.Title, c.Plays))
+	}
+	return strings.Join(str, "\n")
+}
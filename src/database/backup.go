@@ -0,0 +1,161 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupTimeFormat dates the files written by Snapshot so they sort in the
+// order they were taken.
+const backupTimeFormat = "20060102T150405"
+
+// Backup copies the database to path with SQLite's online backup API, which
+// gives a consistent copy even while tracks are being added. PostgreSQL
+// databases are left to pg_dump.
+func (db *DB) Backup(path string) error {
+	if db.Driver != SQLite {
+		return fmt.Errorf("backups are only supported for %s, use the server's own tools for %s", SQLite, db.Driver)
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	return copyDatabase(db.DSN, path)
+}
+
+// Restore replaces the contents of the database with the SQLite database at
+// path, after checking that it holds LocalFM tracks and is not corrupt. The
+// database being replaced is first saved with Snapshot into dir, and the
+// snapshot's path returned.
+func (db *DB) Restore(path, dir string) (string, error) {
+	if db.Driver != SQLite {
+		return "", fmt.Errorf("restoring is only supported for %s, use the server's own tools for %s", SQLite, db.Driver)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+
+	backup, err := Open(SQLite, path)
+	if err != nil {
+		return "", err
+	}
+	defer backup.Close()
+	if existing, err := columnNames(&backup.DB, SQLite, "tracks"); err != nil {
+		return "", fmt.Errorf("%s: %s", path, err)
+	} else if len(existing) == 0 {
+		return "", fmt.Errorf("%s is not a LocalFM database", path)
+	}
+	if problems, err := backup.integrity(); err != nil {
+		return "", err
+	} else if len(problems) > 0 {
+		return "", fmt.Errorf("%s is damaged: %s", path, strings.Join(problems, "; "))
+	}
+
+	previous, err := db.Snapshot(dir, 0)
+	if err != nil {
+		return "", fmt.Errorf("could not back up the current database: %s", err)
+	}
+	return previous, copyDatabase(path, db.DSN)
+}
+
+// copyDatabase copies the SQLite database at from over the one at to.
+func copyDatabase(from, to string) error {
+	d := &sqlite3.SQLiteDriver{}
+	src, err := d.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := d.Open(to)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	b, err := dest.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return err
+	}
+	for {
+		done, err := b.Step(-1)
+		if err != nil {
+			b.Finish()
+			return err
+		}
+		if done {
+			return b.Finish()
+		}
+		// The database is locked by a writer; try again shortly.
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Snapshot backs the database up into dir, or a backups directory next to
+// it when dir is empty, naming the copy after the database and the time it
+// was taken. When keep is above zero, all but the newest keep snapshots are
+// removed. It returns the path of the new snapshot.
+func (db *DB) Snapshot(dir string, keep int) (string, error) {
+	dir, prefix := db.snapshotDir(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, prefix+time.Now().UTC().Format(backupTimeFormat)+".db")
+	if err := db.Backup(path); err != nil {
+		return "", err
+	}
+	if keep <= 0 {
+		return path, nil
+	}
+
+	snapshots, err := db.snapshots(dir)
+	if err != nil {
+		return path, err
+	}
+	for len(snapshots) > keep {
+		if err := os.Remove(snapshots[0]); err != nil {
+			return path, err
+		}
+		snapshots = snapshots[1:]
+	}
+	return path, nil
+}
+
+// LastSnapshot returns when the newest snapshot in dir was taken, or the zero
+// time if Snapshot has not written one there.
+func (db *DB) LastSnapshot(dir string) (time.Time, error) {
+	snapshots, err := db.snapshots(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, prefix := db.snapshotDir(dir)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(snapshots[i]), prefix), ".db")
+		if t, err := time.Parse(backupTimeFormat, name); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// snapshotDir returns the directory Snapshot writes to given dir, and the
+// prefix of the names of the snapshots in it.
+func (db *DB) snapshotDir(dir string) (string, string) {
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(db.DSN), "backups")
+	}
+	return dir, strings.TrimSuffix(filepath.Base(db.DSN), filepath.Ext(db.DSN)) + "-"
+}
+
+// snapshots returns the paths of the snapshots in dir, oldest first.
+func (db *DB) snapshots(dir string) ([]string, error) {
+	dir, prefix := db.snapshotDir(dir)
+	snapshots, err := filepath.Glob(filepath.Join(dir, prefix+"*.db"))
+	sort.Strings(snapshots)
+	return snapshots, err
+}
@@ -0,0 +1,105 @@
+package database
+
+import "time"
+
+// CheckResult lists the problems Check found.
+type CheckResult struct {
+	// Integrity holds what SQLite's integrity check reported wrong with the
+	// database file.
+	Integrity []string
+	// Orphans counts tracks linked to an artist, album or song that is
+	// missing, by column.
+	Orphans map[string]int
+	// Duplicates are dates at which a profile has more than one track,
+	// which a single listener can not have played.
+	Duplicates []DuplicateDate
+}
+
+// DuplicateDate is a date at which a profile has more than one track.
+type DuplicateDate struct {
+	Profile string
+	Date    time.Time
+	Tracks  int
+}
+
+// OK reports whether Check found nothing wrong.
+func (r CheckResult) OK() bool {
+	return len(r.Integrity) == 0 && len(r.Orphans) == 0 && len(r.Duplicates) == 0
+}
+
+// orphanColumns are the columns of tracks checked for links to missing rows,
+// and the tables they refer to.
+var orphanColumns = []struct{ column, table string }{
+	{"artist_id", "artists"},
+	{"album_id", "albums"},
+	{"song_id", "songs"},
+}
+
+// Check looks for damage to the database file, tracks linked to missing
+// artists, albums or songs, and profiles with several tracks at one date.
+// Only SQLite databases have their file checked.
+func (db *DB) Check() (r CheckResult, err error) {
+	if db.Driver == SQLite {
+		if r.Integrity, err = db.integrity(); err != nil {
+			return r, err
+		}
+	}
+
+	r.Orphans = make(map[string]int)
+	for _, o := range orphanColumns {
+		var count int
+		err := db.Table("tracks").
+			Where(o.column + " IS NULL OR " + o.column + " NOT IN (SELECT id FROM " + o.table + ")").
+			Count(&count).Error
+		if err != nil {
+			return r, err
+		}
+		if count > 0 {
+			r.Orphans[o.column] = count
+		}
+	}
+
+	rows, err := db.Table("tracks").
+		Select("COALESCE(profile, ''), date, COUNT(*)").
+		Group("profile, date").
+		Having("COUNT(*) > 1").
+		Order("profile, date").
+		Rows()
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			d    DuplicateDate
+			date sqlTime
+		)
+		if err := rows.Scan(&d.Profile, &date, &d.Tracks); err != nil {
+			return r, err
+		}
+		d.Date = date.Time
+		r.Duplicates = append(r.Duplicates, d)
+	}
+	return r, rows.Err()
+}
+
+// integrity runs SQLite's integrity check, returning the problems it found.
+func (db *DB) integrity() ([]string, error) {
+	rows, err := db.Raw("PRAGMA integrity_check").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
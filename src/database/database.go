@@ -1,40 +1,59 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/caarlos0/gohome"
-	"github.com/dustin/go-humanize"
 	"github.com/jinzhu/gorm"
-	"github.com/spf13/viper"
-	// required by gorm
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // Datastore interface
 type Datastore interface {
 	AddArtist(name string) bool
-	AddTrack(artist, album, title string, date time.Time) bool
-	FindLastListen() (int64, error)
-	RecentTracks() (string, error)
-	Scrobbles() string
-	TopArtists() (string, error)
-	TopAlbums() (string, error)
-	TopSongs() (string, error)
+	AddTrack(track Track) (bool, error)
+	AdoptTracks(profile string) error
+	RepairDate(track Track) (bool, error)
+	FindLastListen(profile string) (int64, error)
+	SourcePlays(profile, source, artist, title string) (int, time.Time, error)
+	Checkpoint(profile string) (ImportCheckpoint, bool)
+	SaveCheckpoint(cp ImportCheckpoint) error
+	ClearCheckpoint(profile string) error
+	AddSession(profile string) (string, error)
+	SessionProfile(key string) (string, bool)
+	RecentTracks(q Query) ([]Track, error)
+	ArtistListens(q Query, artist string) ([]Track, error)
+	AlbumListens(q Query, artist, album string) ([]Track, error)
+	EachTrack(q Query, fn func(Track) error) error
+	Scrobbles(q Query) (Totals, error)
+	TopArtists(q Query) ([]ArtistCount, error)
+	TopAlbums(q Query) ([]AlbumCount, error)
+	TopSongs(q Query) ([]SongCount, error)
+	Snapshot(dir string, keep int) (string, error)
+	LastSnapshot(dir string) (time.Time, error)
+	Transaction(fn func(Datastore) error) error
 }
 
-// DB struct
+// DB struct. MergeWindow is how far apart two sources may date the same
+// listen for AddTrack to treat them as one. Driver and DSN are what the
+// database was opened with.
 type DB struct {
 	gorm.DB
+	MergeWindow time.Duration
+	Driver      string
+	DSN         string
 }
 
 const appName = "localfm"
 
+// DefaultMergeWindow covers Last.fm's minute resolution dates and the few
+// seconds players differ by when they timestamp a play.
+const DefaultMergeWindow = 2 * time.Minute
+
 // Artist struct
 type Artist struct {
 	ID     int    `sql:"index"`
@@ -42,14 +61,49 @@ type Artist struct {
 	Tracks []Track
 }
 
-// Track struct
+// Track struct. Profile names the listener the track belongs to. ArtistID,
+// AlbumID and SongID link it to the artist, album and song it was a play of.
+// Title, Artist and Album are not stored with the track but read from those
+// tables. Duration is the length of the track in seconds and, like the
+// MusicBrainz IDs, is only set when the source reported it, as are URL,
+// ImageURL and Loved. URL links to the track's page on the source and
+// ImageURL to its album art. Synthetic marks tracks whose date was made up
+// because the source only kept a play count. A listen is identified by its
+// profile, song and date to the second.
 type Track struct {
-	ID       int `sql:"index"`
-	ArtistID int
-	Title    string
-	Artist   string
-	Album    string
-	Date     time.Time `sql:"unique_index"`
+	ID            int       `sql:"index" json:"-"`
+	Profile       string    `sql:"unique_index:uix_tracks_listen" json:"-"`
+	ArtistID      int       `sql:"type:integer REFERENCES artists(id)" json:"-"`
+	AlbumID       int       `sql:"type:integer REFERENCES albums(id);index" json:"-"`
+	SongID        int       `sql:"type:integer REFERENCES songs(id);index;unique_index:uix_tracks_listen" json:"-"`
+	Title         string    `sql:"-" json:"title"`
+	Artist        string    `sql:"-" json:"artist"`
+	Album         string    `sql:"-" json:"album"`
+	Date          time.Time `sql:"unique_index:uix_tracks_listen" json:"date"`
+	Source        string    `json:"source"`
+	Duration      int       `json:"duration,omitempty"`
+	ArtistMBID    string    `gorm:"column:artist_mbid" json:"artist_mbid,omitempty"`
+	ReleaseMBID   string    `gorm:"column:release_mbid" json:"release_mbid,omitempty"`
+	RecordingMBID string    `gorm:"column:recording_mbid" json:"recording_mbid,omitempty"`
+	URL           string    `json:"url,omitempty"`
+	ImageURL      string    `gorm:"column:image_url" json:"image_url,omitempty"`
+	Loved         bool      `json:"loved,omitempty"`
+	Synthetic     bool      `json:"synthetic,omitempty"`
+}
+
+// ImportCheckpoint records the last page an import finished for a profile,
+// along with the page size and scrobble total it was started with. Username
+// and Endpoint are the account and server it was importing from, as the
+// page only means something for them.
+type ImportCheckpoint struct {
+	ID        int    `sql:"index"`
+	Profile   string `sql:"unique_index"`
+	Username  string
+	Endpoint  string
+	Page      int
+	Limit     int
+	Total     int
+	UpdatedAt time.Time
 }
 
 func databasePath() (path string) {
@@ -58,20 +112,77 @@ func databasePath() (path string) {
 	return filepath.Join(path, "cache.db")
 }
 
-// NewDB establishes a connection with the database and sets the DB struct
-func NewDB() (*DB, error) {
-	var err error
-	db, err := gorm.Open("sqlite3", databasePath())
+// Open connects to the database without changing its schema. driver is
+// SQLite or Postgres and defaults to SQLite. dsn is the path of the SQLite
+// database file, which defaults to cache.db in the user's cache directory, or
+// a PostgreSQL connection string.
+func Open(driver, dsn string) (*DB, error) {
+	if driver == "" {
+		driver = SQLite
+	}
+	sqlDriver := driverName
+	switch driver {
+	case SQLite:
+		if dsn == "" {
+			dsn = databasePath()
+		}
+	case Postgres:
+		if dsn == "" {
+			return nil, fmt.Errorf("database.dsn must be set to use %s", driver)
+		}
+		if !registered(driver) {
+			return nil, fmt.Errorf("this build of %s has no %s driver, rebuild it with -tags postgres", appName, driver)
+		}
+		sqlDriver = driver
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, expected %s or %s", driver, SQLite, Postgres)
+	}
+
+	db, err := gorm.Open(driver, sqlDriver, dsn)
 	if err != nil {
 		return nil, err
 	}
-
 	db.LogMode(false)
-	db.CreateTable(&Artist{})
-	db.CreateTable(&Track{})
-	db.AutoMigrate(&Artist{}, &Track{})
+	return &DB{DB: db, MergeWindow: DefaultMergeWindow, Driver: driver, DSN: dsn}, nil
+}
+
+// NewDB establishes a connection with the database and sets the DB struct.
+// Pending migrations are applied, after backing up the database into
+// backupDir.
+func NewDB(driver, dsn, backupDir string) (*DB, error) {
+	db, err := Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
 
-	return &DB{db}, nil
+	backup, err := db.BackupBeforeMigrating(backupDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not back up database before migrating: %s", err)
+	}
+	if backup != "" {
+		log.Printf("Backed up database to %s\n", backup)
+	}
+	err = db.Migrate(func(m Migration) {
+		log.Printf("Migrating database to version %d: %s\n", m.Version, m.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Transaction calls fn with a Datastore whose changes are committed together
+// if fn returns nil and rolled back if it returns an error.
+func (db *DB) Transaction(fn func(Datastore) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(&DB{DB: *tx, MergeWindow: db.MergeWindow, Driver: db.Driver, DSN: db.DSN}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
 }
 
 // AddArtist Inserts a new artist into the database
@@ -86,51 +197,148 @@ func (db *DB) AddArtist(name string) bool {
 	return false
 }
 
-// findArtistID by artist name
-func (db *DB) findArtistID(artist string) (artistID int) {
-	row := db.Table("artists").
-		Where("name = ?", artist).
-		Select("id").
-		Row()
-	row.Scan(&artistID)
-	return artistID
+// AddTrack inserts a track into the database unless it is already there,
+// reporting whether it was added. Dates are kept to the second. A track is
+// already there if its profile has the same artist and title at the same
+// date, or at a date within MergeWindow from a different source.
+func (db *DB) AddTrack(track Track) (bool, error) {
+	track.ID = 0
+	track.Date = track.Date.UTC().Truncate(time.Second)
+
+	var count int
+	err := db.Table("tracks").
+		Where("profile = ? AND date = ? AND "+songNamed(false),
+			track.Profile, track.Date, track.Artist, track.Title).
+		Count(&count).Error
+	if err != nil || count > 0 {
+		return false, err
+	}
+
+	if db.MergeWindow > 0 {
+		err := db.Table("tracks").
+			Where("profile = ? AND date BETWEEN ? AND ?", track.Profile,
+				track.Date.Add(-db.MergeWindow), track.Date.Add(db.MergeWindow)).
+			Where(songNamed(true), track.Artist, track.Title).
+			Where("COALESCE(source, '') <> ?", track.Source).
+			Count(&count).Error
+		if err != nil || count > 0 {
+			return false, err
+		}
+	}
+
+	if track.ArtistID, err = db.artistID(track.Artist); err != nil {
+		return false, err
+	}
+	if track.AlbumID, err = db.albumID(track); err != nil {
+		return false, err
+	}
+	if track.SongID, err = db.songID(track); err != nil {
+		return false, err
+	}
+	if err := db.Create(&track).Error; err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// AddTrack inserts a track into the database
-func (db *DB) AddTrack(artist, album, title string, date time.Time) bool {
-	artistID := db.findArtistID(artist)
+// songNamed is a condition matching tracks of the song with an artist and
+// title given as its two arguments, compared without case if fold is set.
+func songNamed(fold bool) string {
+	match := "artists.name = ? AND songs.title = ?"
+	if fold {
+		match = "lower(artists.name) = lower(?) AND lower(songs.title) = lower(?)"
+	}
+	return `song_id IN (SELECT songs.id FROM songs
+		JOIN artists ON artists.id = songs.artist_id WHERE ` + match + ")"
+}
+
+// AdoptTracks assigns tracks stored without a profile to profile.
+func (db *DB) AdoptTracks(profile string) error {
+	return db.Table("tracks").
+		Where("profile = ? OR profile IS NULL", "").
+		UpdateColumn("profile", profile).Error
+}
 
-	track := Track{
-		Title:    title,
-		Artist:   artist,
-		Album:    album,
-		ArtistID: artistID,
-		Date:     date,
+// RepairDate corrects the date of a track stored with its seconds cut off,
+// reporting whether it changed anything. The stored track is found by
+// track's profile, artist, title and date truncated to the minute. If a copy
+// with the exact date is already stored, the truncated one is removed.
+func (db *DB) RepairDate(track Track) (bool, error) {
+	exact := track.Date.UTC().Truncate(time.Second)
+	minute := exact.Truncate(time.Minute)
+	if exact.Equal(minute) {
+		return false, nil
 	}
 
-	if db.NewRec("tracks", "date", date.String()) {
-		db.Create(&track)
-		return true
+	stored := func(date time.Time) *gorm.DB {
+		return db.Table("tracks").
+			Where("profile = ? AND date = ? AND "+songNamed(false),
+				track.Profile, date, track.Artist, track.Title)
 	}
-	return false
+
+	var count int
+	stored(exact).Count(&count)
+	if count > 0 {
+		res := stored(minute).Delete(Track{})
+		return res.RowsAffected > 0, res.Error
+	}
+
+	res := stored(minute).UpdateColumn("date", exact)
+	return res.RowsAffected > 0, res.Error
 }
 
-func (db *DB) FindLastListen() (int64, error) {
+// FindLastListen returns the unix time of profile's newest track, or 0 if it
+// has none.
+func (db *DB) FindLastListen(profile string) (int64, error) {
 	var date time.Time
 
 	row := db.Table("tracks").
-		Order("id desc").
+		Where("profile = ?", profile).
+		Order("date desc").
 		Limit(1).
 		Select("date").
 		Row()
-	row.Scan(&date)
-
-	t, err := time.Parse("2006-01-02 15:04:05 -0700 UTC", date.String())
-	if err != nil {
+	if err := row.Scan(&date); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
 		return 0, err
 	}
+	return date.UTC().Unix(), nil
+}
+
+// SourcePlays counts profile's tracks of artist and title imported from
+// source, returning the date of the newest.
+func (db *DB) SourcePlays(profile, source, artist, title string) (count int, newest time.Time, err error) {
+	var last sqlTime
+	err = db.Table("tracks").
+		Where("profile = ? AND source = ? AND "+songNamed(false), profile, source, artist, title).
+		Select("COUNT(*), MAX(date)").
+		Row().
+		Scan(&count, &last)
+	return count, last.Time, err
+}
+
+// Checkpoint returns the saved import checkpoint for profile, if there is one.
+func (db *DB) Checkpoint(profile string) (cp ImportCheckpoint, ok bool) {
+	if db.Where("profile = ?", profile).First(&cp).RecordNotFound() {
+		return cp, false
+	}
+	return cp, true
+}
+
+// SaveCheckpoint creates or updates the import checkpoint for cp.Profile.
+func (db *DB) SaveCheckpoint(cp ImportCheckpoint) error {
+	var existing ImportCheckpoint
+	if !db.Where("profile = ?", cp.Profile).First(&existing).RecordNotFound() {
+		cp.ID = existing.ID
+	}
+	cp.UpdatedAt = time.Now().UTC()
+	return db.Save(&cp).Error
+}
 
-	return t.UTC().Unix(), nil
+// ClearCheckpoint removes the import checkpoint for profile.
+func (db *DB) ClearCheckpoint(profile string) error {
+	return db.Where("profile = ?", profile).Delete(ImportCheckpoint{}).Error
 }
 
 // NewRec returns a bool depending on whether or not it could find a record
@@ -163,167 +371,6 @@ func (db *DB) NewRec(table, field, data string) bool {
 	return false
 }
 
-//RecentTracks returns a string of recently played tracks.
-func (db *DB) RecentTracks() (s string, err error) {
-	var (
-		title  string
-		artist string
-		date   time.Time
-	)
-
-	rows, err := db.Table("tracks").
-		Select("title, artist, date").
-		Order("id desc").
-		Limit(viper.GetInt("main.recent_tracks")).
-		Rows()
-	if err != nil {
-		return "", err
-	}
-	defer rows.Close()
-
-	var str []string
-	for rows.Next() {
-		rows.Scan(&title, &artist, &date)
-		t, err := time.Parse("2006-01-02 15:04:05 -0700 UTC", date.String())
-		if err != nil {
-			return "", err
-		}
-		d := humanize.Time(t)
-		str = append(str, fmt.Sprintf("%s - %s %s", artist, title, d))
-	}
-	return strings.Join(str, "\n"), nil
-}
-
-//Scrobbles returns a string with your userrname, number of scrobbles, artists,
-// and your first play date.
-func (db *DB) Scrobbles() (s string) {
-	var (
-		scrobblesCount int64
-		artistsCount   int64
-		date           time.Time
-	)
-
-	scrobbles := db.Table("tracks").Count(&scrobblesCount).Row()
-	scrobbles.Scan(&scrobblesCount)
-
-	artists := db.Table("artists").Count(&artistsCount)
-	artists.Scan(&artistsCount)
-
-	since := db.Table("tracks").Select("date").Order("date asc").Limit(1).Row()
-	since.Scan(&date)
-
-	d := date.Format("02 Jan 2006")
-
-	s = fmt.Sprintf("%s     Scrobbles: %s     Artists: %s     Since: %s",
-		viper.GetString("main.lastfm_username"),
-		humanize.Comma(scrobblesCount),
-		humanize.Comma(artistsCount),
-		d)
-	return s
-
-}
-
-// TopArtists returns a string of your top played artists
-func (db *DB) TopArtists() (s string, err error) {
-	type Result struct {
-		Artist string
-		Plays  int
-	}
-
-	sql := fmt.Sprintf("SELECT artist, COUNT(artist) AS plays FROM tracks GROUP BY artist ORDER BY COUNT(artist) DESC LIMIT %d;", viper.GetInt("main.top_artists"))
-	rows, err := db.Raw(sql).Rows()
-	if err != nil {
-		return "", err
-	}
-
-	defer rows.Close()
-
-	plays := make([]*Result, 0)
-	for rows.Next() {
-		play := new(Result)
-		err := rows.Scan(&play.Artist, &play.Plays)
-		if err != nil {
-			return "", err
-		}
-		plays = append(plays, play)
-	}
-
-	var str []string
-	for _, p := range plays {
-		str = append(str, fmt.Sprintf("%s (%d plays)", p.Artist, p.Plays))
-	}
-
-	return strings.Join(str, "\n"), nil
-}
-
-// TopAlbums returns a string of your top played albums.
-func (db *DB) TopAlbums() (s string, err error) {
-	type Result struct {
-		Artist string
-		Album  string
-		Plays  int
-	}
-
-	sql := fmt.Sprintf("SELECT artist, album, COUNT(album) AS plays FROM tracks GROUP BY album, artist ORDER BY COUNT(album) DESC LIMIT %d;", viper.GetInt("main.top_albums"))
-	rows, err := db.Raw(sql).Rows()
-	if err != nil {
-		return "", err
-	}
-
-	defer rows.Close()
-
-	plays := make([]*Result, 0)
-	for rows.Next() {
-		play := new(Result)
-		err := rows.Scan(&play.Artist, &play.Album, &play.Plays)
-		if err != nil {
-			return "", err
-		}
-		plays = append(plays, play)
-	}
-
-	var str []string
-	for _, p := range plays {
-		str = append(str, fmt.Sprintf("%s - %s (%d plays)", p.Artist, p.Album, p.Plays))
-	}
-
-	return strings.Join(str, "\n"), nil
-}
-
-// TopSongs returns a string of your top played songs.
-func (db *DB) TopSongs() (s string, err error) {
-	type Result struct {
-		Artist string
-		Title  string
-		Plays  int
-	}
-
-	sql := fmt.Sprintf("SELECT artist, title, COUNT(title) AS plays FROM tracks GROUP BY artist, title ORDER BY COUNT(title) DESC LIMIT %d;", viper.GetInt("main.top_songs"))
-	rows, err := db.Raw(sql).Rows()
-	if err != nil {
-		return "", err
-	}
-
-	defer rows.Close()
-
-	plays := make([]*Result, 0)
-	for rows.Next() {
-		play := new(Result)
-		err := rows.Scan(&play.Artist, &play.Title, &play.Plays)
-		if err != nil {
-			return "", err
-		}
-		plays = append(plays, play)
-	}
-
-	var str []string
-	for _, p := range plays {
-		str = append(str, fmt.Sprintf("%s - %s (%d plays)", p.Artist, p.Title, p.Plays))
-	}
-
-	return strings.Join(str, "\n"), nil
-}
-
 // isADate returns a bool depending on whether a string is a date or just a string.
 func isADate(date string) bool {
 	_, err := time.Parse("2006-01-02 15:04:05 -0700 UTC", date)
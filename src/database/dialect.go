@@ -0,0 +1,89 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The database drivers LocalFM can store tracks with. SQLite is built in;
+// PostgreSQL needs the binary built with -tags postgres, which links
+// github.com/lib/pq.
+const (
+	SQLite   = "sqlite3"
+	Postgres = "postgres"
+)
+
+// registered reports whether a database/sql driver called name is linked in.
+func registered(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// columnSQL rewrites a column definition written for SQLite into driver's
+// types. PostgreSQL has no datetime type and only generates ids for serial
+// columns.
+func columnSQL(driver, column string) string {
+	if driver != Postgres {
+		return column
+	}
+	fields := strings.Fields(column)
+	switch {
+	case len(fields) > 2 && fields[1] == "integer" && fields[2] == "PRIMARY":
+		fields[1] = "serial"
+	case len(fields) > 1 && fields[1] == "datetime":
+		fields[1] = "timestamp with time zone"
+	}
+	return strings.Join(fields, " ")
+}
+
+// columnNames returns the columns of table, or none if it does not exist.
+func columnNames(tx *gorm.DB, driver, table string) (map[string]bool, error) {
+	if driver == Postgres {
+		return postgresColumnNames(tx, table)
+	}
+	rows, err := tx.Raw(fmt.Sprintf("PRAGMA table_info(%s)", table)).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             *string
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
+
+func postgresColumnNames(tx *gorm.DB, table string) (map[string]bool, error) {
+	rows, err := tx.Raw(`SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ?`, table).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// driverName is go-sqlite3 with foreign key constraints switched on for every
+// connection, which SQLite leaves off by default.
+const driverName = "sqlite3_localfm"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA foreign_keys = ON", nil)
+			return err
+		},
+	})
+}
+
+// Album is a release by an artist. Tracks played without an album belong to
+// the artist's album with an empty title.
+type Album struct {
+	ID       int    `sql:"index"`
+	ArtistID int    `sql:"type:integer REFERENCES artists(id);unique_index:uix_albums_artist_title"`
+	Title    string `sql:"unique_index:uix_albums_artist_title"`
+	MBID     string `gorm:"column:mbid"`
+	ImageURL string `gorm:"column:image_url"`
+}
+
+// Song is a distinct recording by an artist, whichever albums it was played
+// from. Duration is its length in seconds, when known.
+type Song struct {
+	ID       int    `sql:"index"`
+	ArtistID int    `sql:"type:integer REFERENCES artists(id);unique_index:uix_songs_artist_title"`
+	Title    string `sql:"unique_index:uix_songs_artist_title"`
+	MBID     string `gorm:"column:mbid"`
+	Duration int
+}
+
+// artistID returns the ID of the artist called name, adding it if needed.
+func (db *DB) artistID(name string) (int, error) {
+	var artist Artist
+	if db.Where("name = ?", name).First(&artist).RecordNotFound() {
+		artist = Artist{Name: name}
+		err := db.Create(&artist).Error
+		return artist.ID, err
+	}
+	return artist.ID, nil
+}
+
+// albumID returns the ID of track's album, adding it if needed. MusicBrainz
+// IDs and album art missing from a stored album are filled in from track.
+func (db *DB) albumID(track Track) (int, error) {
+	var album Album
+	if db.Where("artist_id = ? AND title = ?", track.ArtistID, track.Album).First(&album).RecordNotFound() {
+		album = Album{
+			ArtistID: track.ArtistID,
+			Title:    track.Album,
+			MBID:     track.ReleaseMBID,
+			ImageURL: track.ImageURL,
+		}
+		err := db.Create(&album).Error
+		return album.ID, err
+	}
+
+	update := map[string]interface{}{}
+	if album.MBID == "" && track.ReleaseMBID != "" {
+		update["mbid"] = track.ReleaseMBID
+	}
+	if album.ImageURL == "" && track.ImageURL != "" {
+		update["image_url"] = track.ImageURL
+	}
+	if len(update) > 0 {
+		if err := db.Model(&album).UpdateColumns(update).Error; err != nil {
+			return 0, err
+		}
+	}
+	return album.ID, nil
+}
+
+// songID returns the ID of track's song, adding it if needed. A missing
+// MusicBrainz ID or duration is filled in from track.
+func (db *DB) songID(track Track) (int, error) {
+	var song Song
+	if db.Where("artist_id = ? AND title = ?", track.ArtistID, track.Title).First(&song).RecordNotFound() {
+		song = Song{
+			ArtistID: track.ArtistID,
+			Title:    track.Title,
+			MBID:     track.RecordingMBID,
+			Duration: track.Duration,
+		}
+		err := db.Create(&song).Error
+		return song.ID, err
+	}
+
+	update := map[string]interface{}{}
+	if song.MBID == "" && track.RecordingMBID != "" {
+		update["mbid"] = track.RecordingMBID
+	}
+	if song.Duration == 0 && track.Duration > 0 {
+		update["duration"] = track.Duration
+	}
+	if len(update) > 0 {
+		if err := db.Model(&song).UpdateColumns(update).Error; err != nil {
+			return 0, err
+		}
+	}
+	return song.ID, nil
+}
@@ -0,0 +1,403 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SchemaMigration records a migration that has been applied.
+type SchemaMigration struct {
+	Version   int `gorm:"primary_key"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migration changes the schema from the version before it to Version. Up
+// runs inside a transaction, which is rolled back if it returns an error,
+// and is given the driver so it can write SQL the database understands.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB, driver string) error
+}
+
+// MigrationStatus is a migration and when it was applied, if it has been.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrations are applied in order. Once released a migration must not be
+// changed; schema changes are made by appending a new one.
+var migrations = []Migration{
+	{1, "create tables", createTables},
+	{2, "link tracks to albums and songs", linkTracks},
+	{3, "read track names from artists, albums and songs", dropTrackNames},
+	{4, "record the account an import checkpoint belongs to", addCheckpointAccount},
+}
+
+// table describes a table as created by createTables.
+type table struct {
+	name    string
+	columns []string
+	indexes []string
+}
+
+// tables is the schema migration 1 creates. Databases made before
+// migrations existed already hold some of these tables, with only some of
+// the columns, so missing columns are added to them.
+var tables = []table{
+	{
+		name:    "artists",
+		columns: []string{`id integer PRIMARY KEY`, `name varchar(255)`},
+		indexes: []string{
+			`CREATE INDEX IF NOT EXISTS idx_artists_id ON artists(id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_artists_name ON artists(name)`,
+		},
+	},
+	{
+		name: "albums",
+		columns: []string{
+			`id integer PRIMARY KEY`,
+			`artist_id integer REFERENCES artists(id)`,
+			`title varchar(255)`,
+			`mbid varchar(255)`,
+			`image_url varchar(255)`,
+		},
+		indexes: []string{
+			`CREATE INDEX IF NOT EXISTS idx_albums_id ON albums(id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_albums_artist_title ON albums(artist_id, title)`,
+		},
+	},
+	{
+		name: "songs",
+		columns: []string{
+			`id integer PRIMARY KEY`,
+			`artist_id integer REFERENCES artists(id)`,
+			`title varchar(255)`,
+			`mbid varchar(255)`,
+			`duration integer`,
+		},
+		indexes: []string{
+			`CREATE INDEX IF NOT EXISTS idx_songs_id ON songs(id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_songs_artist_title ON songs(artist_id, title)`,
+		},
+	},
+	{
+		name: "tracks",
+		columns: []string{
+			`id integer PRIMARY KEY`,
+			`profile varchar(255)`,
+			`artist_id integer REFERENCES artists(id)`,
+			`album_id integer REFERENCES albums(id)`,
+			`song_id integer REFERENCES songs(id)`,
+			`title varchar(255)`,
+			`artist varchar(255)`,
+			`album varchar(255)`,
+			`date datetime`,
+			`source varchar(255)`,
+			`duration integer`,
+			`artist_mbid varchar(255)`,
+			`release_mbid varchar(255)`,
+			`recording_mbid varchar(255)`,
+			`url varchar(255)`,
+			`image_url varchar(255)`,
+			`loved bool`,
+			`synthetic bool`,
+		},
+		indexes: []string{
+			// Older databases identified a listen by its date alone, and
+			// then by profile and date.
+			`DROP INDEX IF EXISTS uix_tracks_date`,
+			`DROP INDEX IF EXISTS uix_tracks_profile_date`,
+			`CREATE INDEX IF NOT EXISTS idx_tracks_id ON tracks(id)`,
+			`CREATE INDEX IF NOT EXISTS idx_tracks_album_id ON tracks(album_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_tracks_song_id ON tracks(song_id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_tracks_listen ON tracks(profile, title, artist, date)`,
+		},
+	},
+	{
+		name: "import_checkpoints",
+		columns: []string{
+			`id integer PRIMARY KEY`,
+			`profile varchar(255)`,
+			`page integer`,
+			`"limit" integer`,
+			`total integer`,
+			`updated_at datetime`,
+		},
+		indexes: []string{
+			`CREATE INDEX IF NOT EXISTS idx_import_checkpoints_id ON import_checkpoints(id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_import_checkpoints_profile ON import_checkpoints(profile)`,
+		},
+	},
+	{
+		name: "sessions",
+		columns: []string{
+			`id integer PRIMARY KEY`,
+			`key varchar(255)`,
+			`profile varchar(255)`,
+			`created_at datetime`,
+		},
+		indexes: []string{
+			`CREATE INDEX IF NOT EXISTS idx_sessions_id ON sessions(id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_sessions_key ON sessions(key)`,
+		},
+	},
+}
+
+// createTables creates tables, or brings tables left by versions of
+// LocalFM from before migrations up to date.
+func createTables(tx *gorm.DB, driver string) error {
+	for _, t := range tables {
+		existing, err := columnNames(tx, driver, t.name)
+		if err != nil {
+			return err
+		}
+
+		columns := make([]string, len(t.columns))
+		for i, column := range t.columns {
+			columns[i] = columnSQL(driver, column)
+		}
+
+		if len(existing) == 0 {
+			sql := fmt.Sprintf("CREATE TABLE %s (%s)", t.name, strings.Join(columns, ", "))
+			if err := tx.Exec(sql).Error; err != nil {
+				return err
+			}
+		} else {
+			for _, column := range columns {
+				name := strings.Trim(strings.Fields(column)[0], `"`)
+				if existing[name] {
+					continue
+				}
+				sql := fmt.Sprintf("ALTER TABLE %s ADD %s", t.name, column)
+				if err := tx.Exec(sql).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, sql := range t.indexes {
+			if err := tx.Exec(sql).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// linkTracksSQL links tracks stored before albums and songs existed to their
+// artist, album and song, adding any that are missing. MusicBrainz IDs,
+// album art and durations are taken from the tracks where they were known.
+var linkTracksSQL = []string{
+	`INSERT INTO artists (name)
+		SELECT DISTINCT artist FROM tracks
+		WHERE album_id IS NULL AND artist NOT IN (SELECT name FROM artists)`,
+	`UPDATE tracks SET artist_id = (SELECT id FROM artists WHERE name = tracks.artist)
+		WHERE album_id IS NULL`,
+	`INSERT INTO albums (artist_id, title, mbid, image_url)
+		SELECT artist_id, COALESCE(album, ''), MAX(COALESCE(release_mbid, '')), MAX(COALESCE(image_url, ''))
+		FROM tracks t
+		WHERE album_id IS NULL AND NOT EXISTS (
+			SELECT 1 FROM albums a WHERE a.artist_id = t.artist_id AND a.title = COALESCE(t.album, ''))
+		GROUP BY artist_id, COALESCE(album, '')`,
+	`UPDATE tracks SET album_id = (
+			SELECT id FROM albums a WHERE a.artist_id = tracks.artist_id AND a.title = COALESCE(tracks.album, ''))
+		WHERE album_id IS NULL`,
+	`INSERT INTO songs (artist_id, title, mbid, duration)
+		SELECT artist_id, title, MAX(COALESCE(recording_mbid, '')), MAX(COALESCE(duration, 0))
+		FROM tracks t
+		WHERE song_id IS NULL AND NOT EXISTS (
+			SELECT 1 FROM songs s WHERE s.artist_id = t.artist_id AND s.title = t.title)
+		GROUP BY artist_id, title`,
+	`UPDATE tracks SET song_id = (
+			SELECT id FROM songs s WHERE s.artist_id = tracks.artist_id AND s.title = tracks.title)
+		WHERE song_id IS NULL`,
+}
+
+// linkTracks runs linkTracksSQL.
+func linkTracks(tx *gorm.DB, driver string) error {
+	for _, stmt := range linkTracksSQL {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackColumns are the columns of tracks once dropTrackNames has removed the
+// names of the artist, album and song, which are kept in their own tables.
+var trackColumns = []string{
+	`id integer PRIMARY KEY`,
+	`profile varchar(255)`,
+	`artist_id integer REFERENCES artists(id)`,
+	`album_id integer REFERENCES albums(id)`,
+	`song_id integer REFERENCES songs(id)`,
+	`date datetime`,
+	`source varchar(255)`,
+	`duration integer`,
+	`artist_mbid varchar(255)`,
+	`release_mbid varchar(255)`,
+	`recording_mbid varchar(255)`,
+	`url varchar(255)`,
+	`image_url varchar(255)`,
+	`loved bool`,
+	`synthetic bool`,
+}
+
+// dropTrackNames removes the title, artist and album columns from tracks,
+// which repeated the names of its song, artist and album for every listen,
+// and identifies listens by song instead. SQLite tables are rebuilt, as
+// columns in an index can not be dropped.
+func dropTrackNames(tx *gorm.DB, driver string) error {
+	if err := linkTracks(tx, driver); err != nil {
+		return err
+	}
+	var unlinked int
+	err := tx.Table("tracks").
+		Where("artist_id IS NULL OR album_id IS NULL OR song_id IS NULL").
+		Count(&unlinked).Error
+	if err != nil {
+		return err
+	}
+	if unlinked > 0 {
+		return fmt.Errorf("%d tracks are not linked to an artist, album and song and would lose their names", unlinked)
+	}
+
+	var stmts []string
+	if driver == SQLite {
+		columns := make([]string, len(trackColumns))
+		names := make([]string, len(trackColumns))
+		for i, column := range trackColumns {
+			columns[i] = columnSQL(driver, column)
+			names[i] = strings.Fields(column)[0]
+		}
+		stmts = []string{
+			fmt.Sprintf("CREATE TABLE tracks_new (%s)", strings.Join(columns, ", ")),
+			fmt.Sprintf("INSERT INTO tracks_new (%[1]s) SELECT %[1]s FROM tracks", strings.Join(names, ", ")),
+			`DROP TABLE tracks`,
+			`ALTER TABLE tracks_new RENAME TO tracks`,
+			`CREATE INDEX idx_tracks_id ON tracks(id)`,
+			`CREATE INDEX idx_tracks_album_id ON tracks(album_id)`,
+			`CREATE INDEX idx_tracks_song_id ON tracks(song_id)`,
+		}
+	} else {
+		stmts = []string{
+			`DROP INDEX IF EXISTS uix_tracks_listen`,
+			`ALTER TABLE tracks DROP COLUMN title, DROP COLUMN artist, DROP COLUMN album`,
+		}
+	}
+	stmts = append(stmts, `CREATE UNIQUE INDEX uix_tracks_listen ON tracks(profile, song_id, date)`)
+
+	for _, stmt := range stmts {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCheckpointAccount adds the username and endpoint an import was saved
+// for to import_checkpoints. Checkpoints saved before have neither, and are
+// discarded rather than resumed.
+func addCheckpointAccount(tx *gorm.DB, driver string) error {
+	for _, column := range []string{`username varchar(255)`, `endpoint varchar(255)`} {
+		if err := tx.Exec("ALTER TABLE import_checkpoints ADD " + columnSQL(driver, column)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrations returns every migration and whether it has been applied.
+func (db *DB) Migrations() ([]MigrationStatus, error) {
+	err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS schema_migrations
+		(version integer PRIMARY KEY, name varchar(255), %s)`, columnSQL(db.Driver, "applied_at datetime"))).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []SchemaMigration
+	if err := db.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	at := make(map[int]time.Time)
+	for _, m := range applied {
+		at[m.Version] = m.AppliedAt
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		t, ok := at[m.Version]
+		status[i] = MigrationStatus{Migration: m, Applied: ok, AppliedAt: t}
+	}
+	return status, nil
+}
+
+// Pending returns the migrations that have not been applied yet.
+func (db *DB) Pending() ([]Migration, error) {
+	status, err := db.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, s := range status {
+		if !s.Applied {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies pending migrations in order, each in its own transaction,
+// calling fn before each one. It stops at the first that fails.
+func (db *DB) Migrate(fn func(Migration)) error {
+	pending, err := db.Pending()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		if fn != nil {
+			fn(m)
+		}
+		tx := db.Begin()
+		if err := m.Up(tx, db.Driver); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %s", m.Version, m.Name, err)
+		}
+		applied := SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}
+		if err := tx.Create(&applied).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackupBeforeMigrating takes a snapshot of the database into dir, as
+// Snapshot does, so a failed or unwanted migration can be undone with
+// Restore. Nothing is backed up if there is nothing to migrate or the
+// database is new and empty. It returns the snapshot's path. PostgreSQL
+// databases are left to the server's own backups.
+func (db *DB) BackupBeforeMigrating(dir string) (string, error) {
+	if db.Driver != SQLite {
+		return "", nil
+	}
+	pending, err := db.Pending()
+	if err != nil || len(pending) == 0 {
+		return "", err
+	}
+	if existing, err := columnNames(&db.DB, db.Driver, "tracks"); err != nil || len(existing) == 0 {
+		return "", err
+	}
+	return db.Snapshot(dir, 0)
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParsePeriod returns the date range named by period, relative to now. The
+// names follow Last.fm's: overall, 7day, 1month, 3month, 6month and 12month,
+// plus year:YYYY and month:YYYY-MM for calendar periods. The range includes
+// from and excludes to; zero times leave that end open.
+func ParsePeriod(period string, now time.Time) (from, to time.Time, err error) {
+	now = now.UTC()
+
+	switch period {
+	case "", "overall":
+		return from, to, nil
+	case "7day":
+		return now.AddDate(0, 0, -7), to, nil
+	case "1month":
+		return now.AddDate(0, -1, 0), to, nil
+	case "3month":
+		return now.AddDate(0, -3, 0), to, nil
+	case "6month":
+		return now.AddDate(0, -6, 0), to, nil
+	case "12month":
+		return now.AddDate(-1, 0, 0), to, nil
+	}
+
+	switch {
+	case strings.HasPrefix(period, "year:"):
+		year, err := strconv.Atoi(strings.TrimPrefix(period, "year:"))
+		if err != nil {
+			return from, to, fmt.Errorf("invalid period %q", period)
+		}
+		from = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(1, 0, 0), nil
+	case strings.HasPrefix(period, "month:"):
+		from, err = time.Parse("2006-01", strings.TrimPrefix(period, "month:"))
+		if err != nil {
+			return from, to, fmt.Errorf("invalid period %q", period)
+		}
+		return from, from.AddDate(0, 1, 0), nil
+	}
+
+	return from, to, fmt.Errorf("invalid period %q", period)
+}
+
+// ParseTime accepts a unix timestamp, an RFC 3339 time or a YYYY-MM-DD date.
+// An empty string is the zero time.
+func ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
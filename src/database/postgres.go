@@ -0,0 +1,9 @@
+//go:build postgres
+// +build postgres
+
+package database
+
+import (
+	// registers the postgres driver used when database.driver is postgres
+	_ "github.com/lib/pq"
+)
@@ -0,0 +1,321 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Query selects which of a profile's tracks a statistics method looks at and
+// which page of its results to return. Zero values leave the date range open
+// and the results unpaged.
+type Query struct {
+	Profile string
+	From    time.Time
+	To      time.Time
+	Limit   int
+	Offset  int
+}
+
+// ArtistCount is the number of times an artist was played.
+type ArtistCount struct {
+	Name        string    `json:"name"`
+	Plays       int       `json:"plays"`
+	FirstPlayed time.Time `json:"first_played"`
+	LastPlayed  time.Time `json:"last_played"`
+}
+
+// AlbumCount is the number of times tracks from an album were played.
+type AlbumCount struct {
+	Artist      string    `json:"artist"`
+	Album       string    `json:"album"`
+	Plays       int       `json:"plays"`
+	FirstPlayed time.Time `json:"first_played"`
+	LastPlayed  time.Time `json:"last_played"`
+}
+
+// SongCount is the number of times a song was played.
+type SongCount struct {
+	Artist      string    `json:"artist"`
+	Title       string    `json:"title"`
+	Plays       int       `json:"plays"`
+	FirstPlayed time.Time `json:"first_played"`
+	LastPlayed  time.Time `json:"last_played"`
+}
+
+// Totals summarises the tracks matched by a Query.
+type Totals struct {
+	Scrobbles   int       `json:"scrobbles"`
+	Artists     int       `json:"artists"`
+	Albums      int       `json:"albums"`
+	Songs       int       `json:"songs"`
+	FirstPlayed time.Time `json:"first_played"`
+	LastPlayed  time.Time `json:"last_played"`
+}
+
+// tracks returns the tracks table narrowed to q's profile and date range.
+func (db *DB) tracks(q Query) *gorm.DB {
+	where, args := q.where()
+	return db.Table("tracks").Where(where, args...)
+}
+
+// where returns the condition selecting q's tracks. From is inclusive and To
+// exclusive.
+func (q Query) where() (string, []interface{}) {
+	where := "tracks.profile = ?"
+	args := []interface{}{q.Profile}
+	if !q.From.IsZero() {
+		where += " AND tracks.date >= ?"
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		where += " AND tracks.date < ?"
+		args = append(args, q.To.UTC())
+	}
+	return where, args
+}
+
+// paged applies q's limit and offset to t.
+func paged(t *gorm.DB, q Query) *gorm.DB {
+	if q.Limit > 0 {
+		t = t.Limit(q.Limit)
+	}
+	if q.Offset > 0 {
+		t = t.Offset(q.Offset)
+	}
+	return t
+}
+
+// trackFields are the columns scanTracks reads, with the names of a track's
+// artist, album and song taken from their tables.
+const trackFields = `COALESCE(songs.title, ''), COALESCE(artists.name, ''), COALESCE(albums.title, ''),
+	tracks.date, tracks.source, tracks.duration, tracks.artist_mbid, tracks.release_mbid,
+	tracks.recording_mbid, tracks.url, tracks.image_url, tracks.loved, tracks.synthetic`
+
+// trackJoins joins tracks to the rows trackFields reads names from. Tracks
+// whose rows are missing are still read, with empty names, so Check can
+// report them.
+const trackJoins = `LEFT JOIN artists ON artists.id = tracks.artist_id
+	LEFT JOIN albums ON albums.id = tracks.album_id
+	LEFT JOIN songs ON songs.id = tracks.song_id`
+
+// scanTracks calls fn with each track t selects, reading them one at a time
+// rather than all at once. It stops at the first error fn returns.
+func scanTracks(t *gorm.DB, profile string, fn func(Track) error) error {
+	rows, err := t.Select(trackFields).Joins(trackJoins).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := Track{Profile: profile}
+		var (
+			source, artistMBID, releaseMBID, recordingMBID *string
+			url, imageURL                                  *string
+			duration                                       *int
+			loved, synthetic                               *bool
+		)
+		if err := rows.Scan(&t.Title, &t.Artist, &t.Album, &t.Date, &source, &duration,
+			&artistMBID, &releaseMBID, &recordingMBID, &url, &imageURL, &loved, &synthetic); err != nil {
+			return err
+		}
+		t.Source = deref(source)
+		t.ArtistMBID = deref(artistMBID)
+		t.ReleaseMBID = deref(releaseMBID)
+		t.RecordingMBID = deref(recordingMBID)
+		t.URL = deref(url)
+		t.ImageURL = deref(imageURL)
+		t.Loved = loved != nil && *loved
+		if duration != nil {
+			t.Duration = *duration
+		}
+		t.Synthetic = synthetic != nil && *synthetic
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// listTracks returns every track t selects.
+func listTracks(t *gorm.DB, profile string) ([]Track, error) {
+	tracks := make([]Track, 0)
+	err := scanTracks(t, profile, func(track Track) error {
+		tracks = append(tracks, track)
+		return nil
+	})
+	return tracks, err
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// RecentTracks returns the tracks matched by q, newest first.
+func (db *DB) RecentTracks(q Query) ([]Track, error) {
+	return listTracks(paged(db.tracks(q), q).Order("tracks.date desc"), q.Profile)
+}
+
+// EachTrack calls fn with every track matched by q, oldest first, reading
+// them one at a time rather than all at once. It stops at the first error fn
+// returns.
+func (db *DB) EachTrack(q Query, fn func(Track) error) error {
+	return scanTracks(paged(db.tracks(q), q).Order("tracks.date asc"), q.Profile, fn)
+}
+
+// ArtistListens returns artist's tracks matched by q, newest first.
+func (db *DB) ArtistListens(q Query, artist string) ([]Track, error) {
+	t := paged(db.tracks(q), q).
+		Where("tracks.artist_id = (SELECT id FROM artists WHERE name = ?)", artist).
+		Order("tracks.date desc")
+	return listTracks(t, q.Profile)
+}
+
+// AlbumListens returns the tracks of artist's album matched by q, newest
+// first.
+func (db *DB) AlbumListens(q Query, artist, album string) ([]Track, error) {
+	t := paged(db.tracks(q), q).
+		Where(`tracks.album_id = (SELECT albums.id FROM albums
+			JOIN artists ON artists.id = albums.artist_id
+			WHERE artists.name = ? AND albums.title = ?)`, artist, album).
+		Order("tracks.date desc")
+	return listTracks(t, q.Profile)
+}
+
+// TopArtists returns the most played artists matched by q.
+func (db *DB) TopArtists(q Query) ([]ArtistCount, error) {
+	rows, err := paged(db.tracks(q), q).
+		Select("artists.name, COUNT(*) AS plays, MIN(tracks.date), MAX(tracks.date)").
+		Joins("JOIN artists ON artists.id = tracks.artist_id").
+		Group("artists.id, artists.name").
+		Order("plays DESC, artists.name").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]ArtistCount, 0)
+	for rows.Next() {
+		var (
+			c           ArtistCount
+			first, last sqlTime
+		)
+		if err := rows.Scan(&c.Name, &c.Plays, &first, &last); err != nil {
+			return nil, err
+		}
+		c.FirstPlayed, c.LastPlayed = first.Time, last.Time
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// TopAlbums returns the most played albums matched by q.
+func (db *DB) TopAlbums(q Query) ([]AlbumCount, error) {
+	rows, err := paged(db.tracks(q), q).
+		Select("artists.name, albums.title, COUNT(*) AS plays, MIN(tracks.date), MAX(tracks.date)").
+		Joins("JOIN albums ON albums.id = tracks.album_id JOIN artists ON artists.id = albums.artist_id").
+		Group("albums.id, artists.name, albums.title").
+		Order("plays DESC, artists.name, albums.title").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]AlbumCount, 0)
+	for rows.Next() {
+		var (
+			c           AlbumCount
+			first, last sqlTime
+		)
+		if err := rows.Scan(&c.Artist, &c.Album, &c.Plays, &first, &last); err != nil {
+			return nil, err
+		}
+		c.FirstPlayed, c.LastPlayed = first.Time, last.Time
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// TopSongs returns the most played songs matched by q.
+func (db *DB) TopSongs(q Query) ([]SongCount, error) {
+	rows, err := paged(db.tracks(q), q).
+		Select("artists.name, songs.title, COUNT(*) AS plays, MIN(tracks.date), MAX(tracks.date)").
+		Joins("JOIN songs ON songs.id = tracks.song_id JOIN artists ON artists.id = songs.artist_id").
+		Group("songs.id, artists.name, songs.title").
+		Order("plays DESC, artists.name, songs.title").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]SongCount, 0)
+	for rows.Next() {
+		var (
+			c           SongCount
+			first, last sqlTime
+		)
+		if err := rows.Scan(&c.Artist, &c.Title, &c.Plays, &first, &last); err != nil {
+			return nil, err
+		}
+		c.FirstPlayed, c.LastPlayed = first.Time, last.Time
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// Scrobbles counts the tracks, artists, albums and songs matched by q. Its
+// limit and offset are ignored.
+func (db *DB) Scrobbles(q Query) (t Totals, err error) {
+	var first, last sqlTime
+	row := db.tracks(q).
+		Select("COUNT(*), COUNT(DISTINCT artist_id), COUNT(DISTINCT album_id), COUNT(DISTINCT song_id), MIN(date), MAX(date)").
+		Row()
+	err = row.Scan(&t.Scrobbles, &t.Artists, &t.Albums, &t.Songs, &first, &last)
+	t.FirstPlayed, t.LastPlayed = first.Time, last.Time
+	return t, err
+}
+
+// sqlTime scans the result of MIN or MAX over a date column, which SQLite
+// returns as text rather than a time and PostgreSQL as a time.
+type sqlTime struct {
+	time.Time
+}
+
+// Scan implements sql.Scanner.
+func (t *sqlTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v.UTC()
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	default:
+		return fmt.Errorf("can not scan %T into a time", value)
+	}
+	return nil
+}
+
+func (t *sqlTime) parse(s string) error {
+	for _, layout := range []string{
+		"2006-01-02 15:04:05.999999999-07:00",
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02T15:04:05.999999999Z07:00",
+	} {
+		if parsed, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			t.Time = parsed.UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("can not parse %q as a time", s)
+}
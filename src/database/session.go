@@ -0,0 +1,42 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Session is a key handed to a music player by the scrobble server, tying
+// its submissions to a profile.
+type Session struct {
+	ID        int    `sql:"index"`
+	Key       string `sql:"unique_index"`
+	Profile   string
+	CreatedAt time.Time
+}
+
+// AddSession creates a new session key for profile.
+func (db *DB) AddSession(profile string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	session := Session{
+		Key:     hex.EncodeToString(b),
+		Profile: profile,
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return "", err
+	}
+	return session.Key, nil
+}
+
+// SessionProfile returns the profile a session key was issued to.
+func (db *DB) SessionProfile(key string) (string, bool) {
+	var session Session
+	if db.Where("key = ?", key).First(&session).RecordNotFound() {
+		return "", false
+	}
+	return session.Profile, true
+}
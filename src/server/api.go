@@ -0,0 +1,258 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gregf/localfm/src/database"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// API serves read-only JSON views of the scrobble database.
+type API struct {
+	db             database.Datastore
+	defaultProfile string
+	profiles       map[string]bool
+}
+
+// page is the envelope every paginated API response is wrapped in.
+type page struct {
+	Profile string      `json:"profile"`
+	Page    int         `json:"page"`
+	Limit   int         `json:"limit"`
+	HasMore bool        `json:"has_more"`
+	Items   interface{} `json:"items"`
+}
+
+// NewAPI returns an API over db for profiles. Requests that do not name a
+// profile get defaultProfile.
+func NewAPI(db database.Datastore, defaultProfile string, profiles []string) *API {
+	a := &API{
+		db:             db,
+		defaultProfile: defaultProfile,
+		profiles:       make(map[string]bool),
+	}
+	for _, p := range profiles {
+		a.profiles[p] = true
+	}
+	return a
+}
+
+// Handler returns the routes served by a.
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/recent", a.recent)
+	mux.HandleFunc("/api/top/artists", a.topArtists)
+	mux.HandleFunc("/api/top/albums", a.topAlbums)
+	mux.HandleFunc("/api/top/tracks", a.topTracks)
+	mux.HandleFunc("/api/artist", a.artist)
+	mux.HandleFunc("/api/album", a.album)
+	mux.HandleFunc("/api/totals", a.totals)
+	return mux
+}
+
+// ListenAndServe serves a on addr.
+func (a *API) ListenAndServe(addr string) error {
+	log.Printf("LocalFM API listening on %s\n", addr)
+	return http.ListenAndServe(addr, a.Handler())
+}
+
+// query reads the profile, period, from, to, limit and page parameters of r.
+// From and to override either end of the period. One more row than the limit
+// is requested so callers can tell if there is a next page.
+func (a *API) query(r *http.Request) (q database.Query, pg page, err error) {
+	if r.Method != "GET" {
+		return q, pg, fmt.Errorf("only GET is supported")
+	}
+	form := r.URL.Query()
+
+	q.Profile = form.Get("profile")
+	if q.Profile == "" {
+		q.Profile = a.defaultProfile
+	}
+	if !a.profiles[q.Profile] {
+		return q, pg, fmt.Errorf("unknown profile %q", q.Profile)
+	}
+
+	if q.From, q.To, err = database.ParsePeriod(form.Get("period"), time.Now()); err != nil {
+		return q, pg, err
+	}
+	if v := form.Get("from"); v != "" {
+		if q.From, err = database.ParseTime(v); err != nil {
+			return q, pg, err
+		}
+	}
+	if v := form.Get("to"); v != "" {
+		if q.To, err = database.ParseTime(v); err != nil {
+			return q, pg, err
+		}
+	}
+
+	pg = page{Profile: q.Profile, Page: 1, Limit: defaultPageSize}
+	if v := form.Get("limit"); v != "" {
+		if pg.Limit, err = strconv.Atoi(v); err != nil || pg.Limit < 1 {
+			return q, pg, fmt.Errorf("invalid limit %q", v)
+		}
+		if pg.Limit > maxPageSize {
+			pg.Limit = maxPageSize
+		}
+	}
+	if v := form.Get("page"); v != "" {
+		if pg.Page, err = strconv.Atoi(v); err != nil || pg.Page < 1 {
+			return q, pg, fmt.Errorf("invalid page %q", v)
+		}
+	}
+
+	q.Limit = pg.Limit + 1
+	q.Offset = (pg.Page - 1) * pg.Limit
+	return q, pg, nil
+}
+
+func (a *API) recent(w http.ResponseWriter, r *http.Request) {
+	q, pg, err := a.query(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	tracks, err := a.db.RecentTracks(q)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeListens(w, pg, tracks)
+}
+
+func (a *API) artist(w http.ResponseWriter, r *http.Request) {
+	q, pg, err := a.query(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("name is required"))
+		return
+	}
+	tracks, err := a.db.ArtistListens(q, name)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeListens(w, pg, tracks)
+}
+
+func (a *API) album(w http.ResponseWriter, r *http.Request) {
+	q, pg, err := a.query(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	artist, name := r.URL.Query().Get("artist"), r.URL.Query().Get("name")
+	if artist == "" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("artist is required"))
+		return
+	}
+	tracks, err := a.db.AlbumListens(q, artist, name)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeListens(w, pg, tracks)
+}
+
+func (a *API) writeListens(w http.ResponseWriter, pg page, tracks []database.Track) {
+	if len(tracks) > pg.Limit {
+		pg.HasMore = true
+		tracks = tracks[:pg.Limit]
+	}
+	pg.Items = tracks
+	writeJSON(w, http.StatusOK, pg)
+}
+
+func (a *API) topArtists(w http.ResponseWriter, r *http.Request) {
+	q, pg, err := a.query(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	counts, err := a.db.TopArtists(q)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(counts) > pg.Limit {
+		pg.HasMore = true
+		counts = counts[:pg.Limit]
+	}
+	pg.Items = counts
+	writeJSON(w, http.StatusOK, pg)
+}
+
+func (a *API) topAlbums(w http.ResponseWriter, r *http.Request) {
+	q, pg, err := a.query(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	counts, err := a.db.TopAlbums(q)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(counts) > pg.Limit {
+		pg.HasMore = true
+		counts = counts[:pg.Limit]
+	}
+	pg.Items = counts
+	writeJSON(w, http.StatusOK, pg)
+}
+
+func (a *API) topTracks(w http.ResponseWriter, r *http.Request) {
+	q, pg, err := a.query(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	counts, err := a.db.TopSongs(q)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(counts) > pg.Limit {
+		pg.HasMore = true
+		counts = counts[:pg.Limit]
+	}
+	pg.Items = counts
+	writeJSON(w, http.StatusOK, pg)
+}
+
+func (a *API) totals(w http.ResponseWriter, r *http.Request) {
+	q, _, err := a.query(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	totals, err := a.db.Scrobbles(q)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Profile string `json:"profile"`
+		database.Totals
+	}{q.Profile, totals})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		log.Println("API error:", err)
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
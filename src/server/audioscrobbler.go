@@ -0,0 +1,297 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gregf/localfm/src/database"
+)
+
+// maxBatch is the most scrobbles track.scrobble accepts in one request.
+const maxBatch = 50
+
+// apiError is an error response of the Audioscrobbler 2.0 API.
+type apiError struct {
+	Code    int
+	Message string
+	status  int
+}
+
+var (
+	errInvalidMethod     = apiError{3, "Invalid Method - No method with that name in this package", http.StatusBadRequest}
+	errAuthFailed        = apiError{4, "Authentication Failed - You do not have permissions to access the service", http.StatusForbidden}
+	errInvalidParameters = apiError{6, "Invalid parameters - Your request is missing a required parameter", http.StatusBadRequest}
+	errOperationFailed   = apiError{8, "Operation failed - Most likely the backend service failed. Please try again.", http.StatusInternalServerError}
+	errInvalidSession    = apiError{9, "Invalid session key - Please re-authenticate", http.StatusForbidden}
+)
+
+// Codes of the ignoredMessage element of a scrobble.
+const (
+	ignoredNone = iota
+	ignoredArtist
+	ignoredTrack
+	ignoredTooOld
+	ignoredTooNew
+)
+
+type lfmResponse struct {
+	XMLName    xml.Name      `xml:"lfm" json:"-"`
+	Status     string        `xml:"status,attr" json:"-"`
+	Session    *lfmSession   `xml:"session,omitempty" json:"session,omitempty"`
+	Scrobbles  *lfmScrobbles `xml:"scrobbles,omitempty" json:"scrobbles,omitempty"`
+	NowPlaying *lfmScrobble  `xml:"nowplaying,omitempty" json:"nowplaying,omitempty"`
+}
+
+type lfmSession struct {
+	Name       string `xml:"name" json:"name"`
+	Key        string `xml:"key" json:"key"`
+	Subscriber int    `xml:"subscriber" json:"subscriber"`
+}
+
+type lfmScrobbles struct {
+	Accepted  int           `xml:"accepted,attr" json:"-"`
+	Ignored   int           `xml:"ignored,attr" json:"-"`
+	Attr      lfmCounts     `xml:"-" json:"@attr"`
+	Scrobbles []lfmScrobble `xml:"scrobble" json:"scrobble"`
+}
+
+type lfmCounts struct {
+	Accepted int `json:"accepted"`
+	Ignored  int `json:"ignored"`
+}
+
+type lfmScrobble struct {
+	Track          string     `xml:"track" json:"track"`
+	Artist         string     `xml:"artist" json:"artist"`
+	Album          string     `xml:"album" json:"album"`
+	AlbumArtist    string     `xml:"albumArtist" json:"albumArtist"`
+	Timestamp      int64      `xml:"timestamp,omitempty" json:"timestamp,omitempty"`
+	IgnoredMessage lfmIgnored `xml:"ignoredMessage" json:"ignoredMessage"`
+}
+
+type lfmIgnored struct {
+	Code int    `xml:"code,attr" json:"code"`
+	Text string `xml:",chardata" json:"#text"`
+}
+
+// audioscrobbler serves the subset of the Audioscrobbler 2.0 API music
+// players need to scrobble: auth.getMobileSession, track.scrobble and
+// track.updateNowPlaying. Request signatures are not checked, since players
+// sign with their own Last.fm API secret.
+func (s *Server) audioscrobbler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeLFMError(w, r, errInvalidParameters)
+		return
+	}
+
+	switch r.Form.Get("method") {
+	case "auth.getMobileSession":
+		s.mobileSession(w, r)
+	case "track.scrobble":
+		s.scrobble(w, r)
+	case "track.updateNowPlaying":
+		s.updateNowPlaying(w, r)
+	default:
+		writeLFMError(w, r, errInvalidMethod)
+	}
+}
+
+// mobileSession issues a session key for a username and either its password
+// or an authToken of md5(username + md5(password)).
+func (s *Server) mobileSession(w http.ResponseWriter, r *http.Request) {
+	username := r.Form.Get("username")
+	acct, ok := s.accounts[username]
+	if !ok || acct.Password == "" {
+		writeLFMError(w, r, errAuthFailed)
+		return
+	}
+
+	var given, want string
+	if token := r.Form.Get("authToken"); token != "" {
+		given, want = token, md5hex(username+md5hex(acct.Password))
+	} else {
+		given, want = r.Form.Get("password"), acct.Password
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(want)) != 1 {
+		writeLFMError(w, r, errAuthFailed)
+		return
+	}
+
+	key, err := s.db.AddSession(acct.Profile)
+	if err != nil {
+		log.Println("Could not create session:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeLFM(w, r, lfmResponse{Session: &lfmSession{Name: username, Key: key}})
+}
+
+// account returns the account the request's session key belongs to.
+func (s *Server) account(r *http.Request) (Account, bool) {
+	profile, ok := s.db.SessionProfile(r.Form.Get("sk"))
+	if !ok {
+		return Account{}, false
+	}
+	acct, ok := s.accounts[profile]
+	return acct, ok
+}
+
+func (s *Server) scrobble(w http.ResponseWriter, r *http.Request) {
+	acct, ok := s.account(r)
+	if !ok {
+		writeLFMError(w, r, errInvalidSession)
+		return
+	}
+
+	res := &lfmScrobbles{}
+	var accepted []database.Track
+	for i := 0; i < maxBatch; i++ {
+		artist := param(r.Form, "artist", i)
+		title := param(r.Form, "track", i)
+		ts := param(r.Form, "timestamp", i)
+		if artist == "" && title == "" && ts == "" {
+			break
+		}
+
+		sc := lfmScrobble{
+			Track:       title,
+			Artist:      artist,
+			Album:       param(r.Form, "album", i),
+			AlbumArtist: param(r.Form, "albumArtist", i),
+		}
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		date := time.Unix(unix, 0).UTC()
+		switch {
+		case artist == "":
+			sc.IgnoredMessage = lfmIgnored{ignoredArtist, "Artist was ignored"}
+		case title == "":
+			sc.IgnoredMessage = lfmIgnored{ignoredTrack, "Track was ignored"}
+		case err != nil || unix <= 0:
+			sc.IgnoredMessage = lfmIgnored{ignoredTooOld, "Timestamp was ignored"}
+		case date.After(time.Now().Add(24 * time.Hour)):
+			sc.IgnoredMessage = lfmIgnored{ignoredTooNew, "Timestamp too new"}
+		default:
+			sc.Timestamp = unix
+			duration, _ := strconv.Atoi(param(r.Form, "duration", i))
+			t := database.Track{
+				Profile:       acct.Profile,
+				Artist:        artist,
+				Album:         sc.Album,
+				Title:         title,
+				Date:          date,
+				Duration:      duration,
+				RecordingMBID: param(r.Form, "mbid", i),
+			}
+			// A scrobble that is already stored is a retry, and still
+			// counts as accepted.
+			if _, err := s.store(t); err != nil {
+				log.Printf("Could not store scrobble for %s: %s\n", acct.Profile, err)
+				writeLFMError(w, r, errOperationFailed)
+				return
+			}
+			accepted = append(accepted, t)
+		}
+
+		if sc.IgnoredMessage.Code == ignoredNone {
+			res.Accepted++
+		} else {
+			res.Ignored++
+		}
+		res.Scrobbles = append(res.Scrobbles, sc)
+	}
+
+	if len(res.Scrobbles) == 0 {
+		writeLFMError(w, r, errInvalidParameters)
+		return
+	}
+
+	s.forward(acct, accepted)
+
+	res.Attr = lfmCounts{res.Accepted, res.Ignored}
+	writeLFM(w, r, lfmResponse{Scrobbles: res})
+}
+
+func (s *Server) updateNowPlaying(w http.ResponseWriter, r *http.Request) {
+	acct, ok := s.account(r)
+	if !ok {
+		writeLFMError(w, r, errInvalidSession)
+		return
+	}
+
+	np := NowPlaying{
+		Artist:  r.Form.Get("artist"),
+		Album:   r.Form.Get("album"),
+		Title:   r.Form.Get("track"),
+		Started: time.Now().UTC(),
+	}
+	if np.Artist == "" || np.Title == "" {
+		writeLFMError(w, r, errInvalidParameters)
+		return
+	}
+	s.setPlaying(acct, np)
+
+	writeLFM(w, r, lfmResponse{NowPlaying: &lfmScrobble{
+		Track:       np.Title,
+		Artist:      np.Artist,
+		Album:       np.Album,
+		AlbumArtist: r.Form.Get("albumArtist"),
+	}})
+}
+
+// param returns the value of name[i], or of name for the first item of a
+// request that is not batched.
+func param(form url.Values, name string, i int) string {
+	if v := form.Get(fmt.Sprintf("%s[%d]", name, i)); v != "" {
+		return v
+	}
+	if i == 0 {
+		return form.Get(name)
+	}
+	return ""
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeLFM writes res as XML, or as JSON when the request asks for it.
+func writeLFM(w http.ResponseWriter, r *http.Request, res lfmResponse) {
+	if r.Form.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	res.Status = "ok"
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(res)
+}
+
+func writeLFMError(w http.ResponseWriter, r *http.Request, e apiError) {
+	if r.Form.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(e.status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   e.Code,
+			"message": e.Message,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(e.status)
+	fmt.Fprint(w, xml.Header)
+	fmt.Fprintf(w, "<lfm status=\"failed\">\n  <error code=\"%d\">%s</error>\n</lfm>\n", e.Code, e.Message)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gregf/localfm/src/database"
+	"github.com/gregf/localfm/src/sources"
+)
+
+// Forwarder relays scrobbles to Last.fm, or another server speaking the
+// Last.fm 2.0 API, using a session key the user has already authorised.
+type Forwarder struct {
+	URL        string
+	APIKey     string
+	Secret     string
+	SessionKey string
+}
+
+// Scrobble submits tracks with track.scrobble, in batches of 50.
+func (f *Forwarder) Scrobble(tracks []database.Track) error {
+	for len(tracks) > 0 {
+		n := len(tracks)
+		if n > maxBatch {
+			n = maxBatch
+		}
+
+		params := url.Values{}
+		params.Set("method", "track.scrobble")
+		for i, t := range tracks[:n] {
+			params.Set(fmt.Sprintf("artist[%d]", i), t.Artist)
+			params.Set(fmt.Sprintf("track[%d]", i), t.Title)
+			params.Set(fmt.Sprintf("timestamp[%d]", i), fmt.Sprint(t.Date.Unix()))
+			if t.Album != "" {
+				params.Set(fmt.Sprintf("album[%d]", i), t.Album)
+			}
+		}
+		if err := f.call(params); err != nil {
+			return err
+		}
+		tracks = tracks[n:]
+	}
+	return nil
+}
+
+// UpdateNowPlaying submits np with track.updateNowPlaying.
+func (f *Forwarder) UpdateNowPlaying(np NowPlaying) error {
+	params := url.Values{}
+	params.Set("method", "track.updateNowPlaying")
+	params.Set("artist", np.Artist)
+	params.Set("track", np.Title)
+	if np.Album != "" {
+		params.Set("album", np.Album)
+	}
+	return f.call(params)
+}
+
+// call signs and posts params, returning the API's error if it reports one.
+func (f *Forwarder) call(params url.Values) error {
+	params.Set("api_key", f.APIKey)
+	params.Set("sk", f.SessionKey)
+	params.Set("api_sig", f.sign(params))
+
+	root := f.URL
+	if root == "" {
+		root = sources.LastFMURL
+	}
+	req, err := http.NewRequest("POST", root, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Last.fm reports failures with an error status and the error in the
+	// body, which is returned as an *sources.LFMError.
+	resp, err := sources.LastFMClient.Do(req)
+	var httpErr *sources.HTTPError
+	if errors.As(err, &httpErr) {
+		if e := sources.LastFMError(httpErr.Body); e != nil {
+			return e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var l sources.LFM
+	if err := xml.Unmarshal(body, &l); err != nil {
+		return fmt.Errorf("unreadable response: %s", err)
+	}
+	if l.Status == "failed" && l.Error != nil {
+		return l.Error
+	}
+	if l.Status != "ok" {
+		return fmt.Errorf("unexpected response status %q", l.Status)
+	}
+	return nil
+}
+
+// sign returns the api_sig for params: the md5 of every name and value in
+// name order, followed by the shared secret.
+func (f *Forwarder) sign(params url.Values) string {
+	var names []string
+	for name := range params {
+		if name != "format" && name != "api_sig" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteString(params.Get(name))
+	}
+	b.WriteString(f.Secret)
+	return md5hex(b.String())
+}
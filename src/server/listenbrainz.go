@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gregf/localfm/src/database"
+)
+
+// maxListenSize is the largest submit-listens body accepted, matching
+// ListenBrainz's own limit.
+const maxListenSize = 10240 * 1024
+
+type submission struct {
+	ListenType string   `json:"listen_type"`
+	Payload    []listen `json:"payload"`
+}
+
+type listen struct {
+	ListenedAt    int64         `json:"listened_at"`
+	TrackMetadata trackMetadata `json:"track_metadata"`
+}
+
+type trackMetadata struct {
+	ArtistName     string         `json:"artist_name"`
+	TrackName      string         `json:"track_name"`
+	ReleaseName    string         `json:"release_name"`
+	AdditionalInfo additionalInfo `json:"additional_info"`
+}
+
+type additionalInfo struct {
+	Duration      int      `json:"duration"`
+	DurationMS    int      `json:"duration_ms"`
+	ArtistMBIDs   []string `json:"artist_mbids"`
+	ReleaseMBID   string   `json:"release_mbid"`
+	RecordingMBID string   `json:"recording_mbid"`
+}
+
+// tokenAccount returns the account whose token is in the request's
+// Authorization header.
+func (s *Server) tokenAccount(r *http.Request) (Account, bool) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Token "))
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return Account{}, false
+	}
+	for _, acct := range s.accounts {
+		if acct.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(acct.Token)) == 1 {
+			return acct, true
+		}
+	}
+	return Account{}, false
+}
+
+// validateToken serves GET /1/validate-token, which clients use to check a
+// token before submitting.
+func (s *Server) validateToken(w http.ResponseWriter, r *http.Request) {
+	acct, ok := s.tokenAccount(r)
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    200,
+			"message": "Token invalid.",
+			"valid":   false,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"code":      200,
+		"message":   "Token valid.",
+		"valid":     true,
+		"user_name": acct.Profile,
+	})
+}
+
+// submitListens serves POST /1/submit-listens, storing single and import
+// listens and recording playing_now ones as the account's now playing track.
+func (s *Server) submitListens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeLBError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	acct, ok := s.tokenAccount(r)
+	if !ok {
+		writeLBError(w, http.StatusUnauthorized, "You need to provide an Authorization header.")
+		return
+	}
+
+	var sub submission
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxListenSize)).Decode(&sub); err != nil {
+		writeLBError(w, http.StatusBadRequest, "Cannot parse JSON document: "+err.Error())
+		return
+	}
+	if err := sub.validate(); err != nil {
+		writeLBError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if sub.ListenType == "playing_now" {
+		m := sub.Payload[0].TrackMetadata
+		s.setPlaying(acct, NowPlaying{
+			Artist:  m.ArtistName,
+			Album:   m.ReleaseName,
+			Title:   m.TrackName,
+			Started: time.Now().UTC(),
+		})
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+
+	var tracks []database.Track
+	for _, l := range sub.Payload {
+		t := l.track(acct.Profile)
+		if _, err := s.store(t); err != nil {
+			log.Printf("Could not store listen for %s: %s\n", acct.Profile, err)
+			writeLBError(w, http.StatusInternalServerError, "Could not store listens, please try again.")
+			return
+		}
+		tracks = append(tracks, t)
+	}
+	s.forward(acct, tracks)
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// validate checks sub follows the rules ListenBrainz applies to each listen
+// type.
+func (sub submission) validate() error {
+	switch sub.ListenType {
+	case "single", "playing_now":
+		if len(sub.Payload) != 1 {
+			return fmt.Errorf("JSON document should contain exactly one listen for listen_type %s.", sub.ListenType)
+		}
+	case "import":
+		if len(sub.Payload) == 0 {
+			return fmt.Errorf("JSON document should contain at least one listen.")
+		}
+	default:
+		return fmt.Errorf("JSON document must contain a valid listen_type key.")
+	}
+
+	for _, l := range sub.Payload {
+		m := l.TrackMetadata
+		if m.ArtistName == "" || m.TrackName == "" {
+			return fmt.Errorf("JSON document must contain artist_name and track_name in track_metadata.")
+		}
+		if sub.ListenType == "playing_now" {
+			if l.ListenedAt != 0 {
+				return fmt.Errorf("JSON document must not contain listened_at while submitting playing_now.")
+			}
+		} else if l.ListenedAt <= 0 {
+			return fmt.Errorf("JSON document must contain the key listened_at.")
+		}
+	}
+	return nil
+}
+
+// track converts l into a Track owned by profile.
+func (l listen) track(profile string) database.Track {
+	m := l.TrackMetadata
+	info := m.AdditionalInfo
+
+	t := database.Track{
+		Profile:       profile,
+		Artist:        m.ArtistName,
+		Album:         m.ReleaseName,
+		Title:         m.TrackName,
+		Date:          time.Unix(l.ListenedAt, 0).UTC(),
+		Duration:      info.Duration,
+		ReleaseMBID:   info.ReleaseMBID,
+		RecordingMBID: info.RecordingMBID,
+	}
+	if t.Duration == 0 {
+		t.Duration = info.DurationMS / 1000
+	}
+	if len(info.ArtistMBIDs) > 0 {
+		t.ArtistMBID = info.ArtistMBIDs[0]
+	}
+	return t
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeLBError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"code":  status,
+		"error": msg,
+	})
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gregf/localfm/src/database"
+)
+
+// Source is stored with every track received by the server.
+const Source = "localfm"
+
+// Account is a profile that music players may scrobble to.
+type Account struct {
+	Profile  string
+	Password string
+	// Token authenticates ListenBrainz submissions.
+	Token string
+	// Forward, when set, receives a copy of every scrobble stored for the
+	// account.
+	Forward *Forwarder
+}
+
+// NowPlaying is the track a profile last reported as playing.
+type NowPlaying struct {
+	Artist  string
+	Album   string
+	Title   string
+	Started time.Time
+}
+
+// Server receives scrobbles from music players and stores them.
+type Server struct {
+	db       database.Datastore
+	accounts map[string]Account
+
+	mu      sync.Mutex
+	playing map[string]NowPlaying
+}
+
+// NewServer returns a Server storing scrobbles for accounts in db.
+func NewServer(db database.Datastore, accounts []Account) *Server {
+	s := &Server{
+		db:       db,
+		accounts: make(map[string]Account),
+		playing:  make(map[string]NowPlaying),
+	}
+	for _, a := range accounts {
+		s.accounts[a.Profile] = a
+	}
+	return s
+}
+
+// Handler returns the routes served by s.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/2.0/", s.audioscrobbler)
+	mux.HandleFunc("/1/submit-listens", s.submitListens)
+	mux.HandleFunc("/1/validate-token", s.validateToken)
+	return mux
+}
+
+// ListenAndServe serves s on addr.
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("LocalFM listening on %s\n", addr)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// Playing returns what profile is listening to, if anything.
+func (s *Server) Playing(profile string) (NowPlaying, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	np, ok := s.playing[profile]
+	return np, ok
+}
+
+// setPlaying records what acct is listening to and forwards it.
+func (s *Server) setPlaying(acct Account, np NowPlaying) {
+	s.mu.Lock()
+	s.playing[acct.Profile] = np
+	s.mu.Unlock()
+
+	if acct.Forward != nil {
+		go func() {
+			if err := acct.Forward.UpdateNowPlaying(np); err != nil {
+				log.Printf("Could not forward now playing for %s: %s\n", acct.Profile, err)
+			}
+		}()
+	}
+}
+
+// forward sends tracks on to acct's forwarding server, if it has one.
+func (s *Server) forward(acct Account, tracks []database.Track) {
+	if acct.Forward == nil || len(tracks) == 0 {
+		return
+	}
+	go func() {
+		if err := acct.Forward.Scrobble(tracks); err != nil {
+			log.Printf("Could not forward scrobbles for %s: %s\n", acct.Profile, err)
+		}
+	}()
+}
+
+// store adds a received track to the database, reporting whether it was new.
+func (s *Server) store(t database.Track) (bool, error) {
+	t.Source = Source
+	return s.db.AddTrack(t)
+}
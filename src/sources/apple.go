@@ -0,0 +1,292 @@
+package sources
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ITunesSource and AppleMusicSource are stored with tracks imported from an
+// iTunes library and from Apple Music play activity.
+const (
+	ITunesSource     = "itunes"
+	AppleMusicSource = "apple-music"
+)
+
+// ITunesTrack is a track in an iTunes library with the plays it counts.
+// Length is zero and Added the zero time when the library leaves them out.
+type ITunesTrack struct {
+	Artist     string
+	Album      string
+	Title      string
+	PlayCount  int
+	LastPlayed time.Time
+	Added      time.Time
+	Length     time.Duration
+}
+
+// ReadITunesLibrary calls fn with every played music track in the iTunes
+// Library.xml at path.
+func ReadITunesLibrary(path string, fn func(ITunesTrack) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return readPlistTracks(bufio.NewReader(f), func(t map[string]string) error {
+		for _, kind := range []string{"Podcast", "Movie", "TV Show", "Music Video", "Audiobook"} {
+			if t[kind] == "true" {
+				return nil
+			}
+		}
+		count, _ := strconv.Atoi(t["Play Count"])
+		last, err := time.Parse(time.RFC3339, t["Play Date UTC"])
+		if count == 0 || err != nil || t["Artist"] == "" || t["Name"] == "" {
+			return nil
+		}
+		totalTime, _ := strconv.Atoi(t["Total Time"])
+		added, _ := time.Parse(time.RFC3339, t["Date Added"])
+		return fn(ITunesTrack{
+			Artist:     t["Artist"],
+			Album:      t["Album"],
+			Title:      t["Name"],
+			PlayCount:  count,
+			LastPlayed: last,
+			Added:      added,
+			Length:     time.Duration(totalTime) * time.Millisecond,
+		})
+	})
+}
+
+// Listens returns the plays of t not yet imported, given how many plays of
+// it were already stored from the library and the newest of their dates. A
+// library only records how often a track was played and when it was last
+// played, so only the last play has a real date and the others are marked
+// Synthetic.
+//
+// On the first import the earlier plays are spread evenly between the date
+// the track was added and its last play, or placed one track length apart
+// when that is unknown. Later imports add the last play and spread the
+// plays made since between the newest stored play and it. Plays already
+// stored are never dated again, so importing a library twice, or an updated
+// copy of it, adds each play once.
+func (t ITunesTrack) Listens(stored int, newest time.Time) []Listen {
+	missing := t.PlayCount - stored
+	if missing <= 0 {
+		return nil
+	}
+	last := t.LastPlayed.Truncate(time.Second).UTC()
+
+	first := newest
+	if stored == 0 {
+		step := t.Length
+		if step < time.Minute {
+			step = time.Minute
+		}
+		first = last.Add(-time.Duration(missing) * step)
+		if !t.Added.IsZero() && t.Added.Before(first) {
+			first = t.Added
+		}
+	}
+	if first.After(last) {
+		first = last
+	}
+	span := last.Sub(first)
+
+	listens := make([]Listen, missing)
+	for i := range listens {
+		date := last
+		if i < missing-1 {
+			date = first.Add(span * time.Duration(i+1) / time.Duration(missing))
+		}
+		listens[i] = Listen{
+			Artist:    t.Artist,
+			Album:     t.Album,
+			Title:     t.Title,
+			Date:      date.Truncate(time.Second).UTC(),
+			Source:    ITunesSource,
+			Duration:  int(t.Length / time.Second),
+			Synthetic: i < missing-1,
+		}
+	}
+	return listens
+}
+
+// readPlistTracks calls fn with the keys and values of each entry in the
+// Tracks dictionary of an iTunes library property list, decoding one track
+// at a time.
+func readPlistTracks(r io.Reader, fn func(map[string]string) error) error {
+	dec := xml.NewDecoder(r)
+	depth, tracksDepth := 0, 0
+	key := ""
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch el := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case el.Name.Local == "key":
+				if err := dec.DecodeElement(&key, &el); err != nil {
+					return err
+				}
+				depth--
+			case el.Name.Local != "dict" && el.Name.Local != "plist":
+				if err := dec.Skip(); err != nil {
+					return err
+				}
+				depth--
+			case tracksDepth == 0 && key == "Tracks":
+				tracksDepth = depth
+			case tracksDepth != 0 && depth == tracksDepth+1:
+				t, err := readPlistDict(dec)
+				if err != nil {
+					return err
+				}
+				depth--
+				if err := fn(t); err != nil {
+					return err
+				}
+			}
+		case xml.EndElement:
+			depth--
+			if tracksDepth != 0 && depth < tracksDepth {
+				return nil
+			}
+		}
+	}
+}
+
+// readPlistDict reads the rest of a dict whose start element has been read.
+// Booleans are returned as "true" or "false"; nested dicts and arrays are
+// skipped.
+func readPlistDict(dec *xml.Decoder) (map[string]string, error) {
+	d := make(map[string]string)
+	key := ""
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "key":
+				if err := dec.DecodeElement(&key, &el); err != nil {
+					return nil, err
+				}
+			case "true", "false":
+				d[key] = el.Name.Local
+				if err := dec.Skip(); err != nil {
+					return nil, err
+				}
+			case "dict", "array":
+				if err := dec.Skip(); err != nil {
+					return nil, err
+				}
+			default:
+				var v string
+				if err := dec.DecodeElement(&v, &el); err != nil {
+					return nil, err
+				}
+				d[key] = v
+			}
+		case xml.EndElement:
+			return d, nil
+		}
+	}
+}
+
+// ReadAppleMusicActivity calls fn for every play in the "Apple Music Play
+// Activity.csv" of an Apple privacy data export that passes the scrobble
+// rule. Rows without an artist, which Apple leaves out of some exports,
+// are skipped.
+func ReadAppleMusicActivity(path string, minPlayed time.Duration, fn func(Listen) error) error {
+	if minPlayed <= 0 {
+		minPlayed = DefaultMinPlayed
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cr := csv.NewReader(bufio.NewReader(f))
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.TrimSpace(name)] = i
+	}
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		get := func(names ...string) string {
+			for _, name := range names {
+				if i, ok := cols[name]; ok && i < len(rec) && rec[i] != "" {
+					return strings.TrimSpace(rec[i])
+				}
+			}
+			return ""
+		}
+
+		if t := get("Event Type"); t != "" && t != "PLAY_END" {
+			continue
+		}
+		artist, title := get("Artist Name", "Container Artist Name"), get("Song Name", "Content Name")
+		if artist == "" || title == "" {
+			continue
+		}
+
+		playedMs, _ := strconv.ParseInt(get("Play Duration Milliseconds"), 10, 64)
+		lengthMs, _ := strconv.ParseInt(get("Media Duration In Milliseconds"), 10, 64)
+		played := time.Duration(playedMs) * time.Millisecond
+		length := time.Duration(lengthMs) * time.Millisecond
+		if !Scrobbled(played, length, minPlayed) {
+			continue
+		}
+
+		date, err := time.Parse(time.RFC3339, get("Event Start Timestamp"))
+		if err != nil {
+			end, err := time.Parse(time.RFC3339, get("Event End Timestamp"))
+			if err != nil {
+				continue
+			}
+			date = end.Add(-played)
+		}
+
+		err = fn(Listen{
+			Artist:   artist,
+			Album:    get("Album Name", "Container Album Name"),
+			Title:    title,
+			Date:     date.Truncate(time.Second).UTC(),
+			Source:   AppleMusicSource,
+			Duration: int(length / time.Second),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package sources
+
+import (
+	"testing"
+	"time"
+)
+
+func TestITunesTrackListensAreStable(t *testing.T) {
+	added := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	track := ITunesTrack{
+		Artist:     "A",
+		Title:      "T",
+		PlayCount:  3,
+		LastPlayed: time.Date(2019, 1, 4, 0, 0, 0, 0, time.UTC),
+		Added:      added,
+		Length:     3 * time.Minute,
+	}
+
+	first := track.Listens(0, time.Time{})
+	if len(first) != 3 {
+		t.Fatalf("first import gave %d listens, want 3", len(first))
+	}
+	for i, l := range first {
+		if l.Synthetic != (i < 2) {
+			t.Errorf("listen %d: Synthetic = %v", i, l.Synthetic)
+		}
+		if !l.Date.After(added) || l.Date.After(track.LastPlayed) {
+			t.Errorf("listen %d: date %s outside %s to %s", i, l.Date, added, track.LastPlayed)
+		}
+	}
+
+	if again := track.Listens(3, track.LastPlayed); len(again) != 0 {
+		t.Errorf("importing the same library again gave %d listens, want 0", len(again))
+	}
+
+	track.PlayCount = 5
+	track.LastPlayed = time.Date(2019, 1, 10, 0, 0, 0, 0, time.UTC)
+	update := track.Listens(3, first[2].Date)
+	if len(update) != 2 {
+		t.Fatalf("updated library gave %d listens, want 2", len(update))
+	}
+	if !update[1].Date.Equal(track.LastPlayed) || update[1].Synthetic {
+		t.Errorf("last play = %+v, want the real play at %s", update[1], track.LastPlayed)
+	}
+	if !update[0].Date.After(first[2].Date) || !update[0].Date.Before(track.LastPlayed) {
+		t.Errorf("new play dated %s, want between %s and %s", update[0].Date, first[2].Date, track.LastPlayed)
+	}
+}
+
+func TestITunesTrackListensWithoutDateAdded(t *testing.T) {
+	track := ITunesTrack{
+		Artist:     "A",
+		Title:      "T",
+		PlayCount:  2,
+		LastPlayed: time.Date(2019, 1, 4, 0, 0, 0, 0, time.UTC),
+		Length:     10 * time.Second,
+	}
+	l := track.Listens(0, time.Time{})
+	if len(l) != 2 {
+		t.Fatalf("got %d listens, want 2", len(l))
+	}
+	if gap := l[1].Date.Sub(l[0].Date); gap != time.Minute {
+		t.Errorf("plays %s apart, want a minute for a short track", gap)
+	}
+}
@@ -0,0 +1,241 @@
+package sources
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client sends API requests with a timeout, retrying transient failures with
+// exponential backoff and spacing requests out to stay under a rate limit.
+type Client struct {
+	HTTP *http.Client
+	// MaxRetries is how many times a failed request is retried.
+	MaxRetries int
+	// MinBackoff is the wait before the first retry, doubled for each
+	// retry after it up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retry reports whether a response is a transient failure. It defaults
+	// to retrying 429 Too Many Requests and 5xx server errors.
+	Retry func(status int, body []byte) bool
+
+	bucket *tokenBucket
+}
+
+// DefaultClient is used for requests to APIs without a documented rate
+// limit.
+var DefaultClient = NewClient(0)
+
+// NewClient returns a Client making at most perSecond requests a second, or
+// any number when perSecond is zero.
+func NewClient(perSecond float64) *Client {
+	c := &Client{
+		HTTP:       &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 5,
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+		Retry:      retryableStatus,
+	}
+	if perSecond > 0 {
+		c.bucket = newTokenBucket(perSecond)
+	}
+	return c
+}
+
+// HTTPError is a response with a status outside 2xx. URL leaves out the
+// query, which may hold an API key. Body holds the response so callers can
+// decode the API's own error from it.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: %s", e.URL, e.Status)
+}
+
+// RetryError is returned when a request still failed after every retry. Err
+// is the last failure.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts: %s", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether err is a failure that may clear up if the
+// request is made again later, such as a timeout or an overloaded server.
+func Temporary(err error) bool {
+	var retry *RetryError
+	if errors.As(err, &retry) {
+		return true
+	}
+	var lfm *LFMError
+	if errors.As(err, &lfm) {
+		return lfm.Temporary()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryableStatus reports whether status is worth retrying.
+func retryableStatus(status int, body []byte) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Do sends req with the LocalFM user agent set, reading the whole response
+// body. Network errors and responses Retry accepts are retried; any other
+// status outside 2xx is returned as an *HTTPError. Requests with a body are
+// only retried if it can be sent again.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", UserAgent)
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt > c.MaxRetries || (req.Body != nil && req.GetBody == nil) {
+				return nil, &RetryError{Attempts: attempt, Err: lastErr}
+			}
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+			time.Sleep(c.backoff(attempt, lastErr))
+		}
+		if c.bucket != nil {
+			c.bucket.wait()
+		}
+
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if c.Retry(resp.StatusCode, body) {
+			lastErr = &retryAfterError{
+				HTTPError: HTTPError{URL: withoutQuery(req.URL), StatusCode: resp.StatusCode, Status: resp.Status, Body: body},
+				after:     retryAfter(resp),
+			}
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, &HTTPError{URL: withoutQuery(req.URL), StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+		}
+		return resp, nil
+	}
+}
+
+// retryAfterError is a retryable response and how long it asked to be left
+// before the next attempt.
+type retryAfterError struct {
+	HTTPError
+	after time.Duration
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return &e.HTTPError
+}
+
+func withoutQuery(u *url.URL) string {
+	v := *u
+	v.RawQuery = ""
+	return v.String()
+}
+
+// retryAfter reads a Retry-After header given in seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 0
+}
+
+// backoff returns how long to wait before attempt: MinBackoff doubled for
+// each earlier retry, capped at MaxBackoff, with up to half of it taken off
+// at random so clients that failed together do not retry together. A longer
+// Retry-After from the server is respected.
+func (c *Client) backoff(attempt int, err error) time.Duration {
+	d := c.MinBackoff
+	for i := 1; i < attempt && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	if d > 0 {
+		d -= time.Duration(rand.Int63n(int64(d)/2 + 1))
+	}
+
+	var ra *retryAfterError
+	if errors.As(err, &ra) && ra.after > d {
+		d = ra.after
+	}
+	return d
+}
+
+// tokenBucket allows rate requests a second on average, with bursts of up
+// to rate requests after a quiet spell.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	// now and sleep are time.Now and time.Sleep, replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now(), now: time.Now, sleep: time.Sleep}
+}
+
+// wait blocks until a request may be made. Callers waiting together are
+// each given a later slot.
+func (b *tokenBucket) wait() {
+	b.mu.Lock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens--
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if d > 0 {
+		b.sleep(d)
+	}
+}
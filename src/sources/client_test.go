@@ -0,0 +1,217 @@
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackoffBounds(t *testing.T) {
+	c := &Client{MinBackoff: time.Second, MaxBackoff: 8 * time.Second}
+	// Each retry doubles the wait up to MaxBackoff; up to half is taken off.
+	waits := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for i, full := range waits {
+		attempt := i + 1
+		for j := 0; j < 100; j++ {
+			if d := c.backoff(attempt, nil); d < full/2 || d > full {
+				t.Fatalf("backoff(%d) = %s, want %s to %s", attempt, d, full/2, full)
+			}
+		}
+	}
+
+	retry := &retryAfterError{after: 30 * time.Second}
+	if d := c.backoff(1, retry); d != 30*time.Second {
+		t.Errorf("backoff with Retry-After 30s = %s", d)
+	}
+	retry.after = time.Millisecond
+	if d := c.backoff(1, retry); d < 500*time.Millisecond {
+		t.Errorf("backoff with a short Retry-After = %s, want at least %s", d, 500*time.Millisecond)
+	}
+}
+
+// fakeClock is a clock that only moves when slept on.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+// withinMs reports whether d is within a millisecond of want, allowing for
+// rounding in the bucket's arithmetic.
+func withinMs(d, want time.Duration) bool {
+	return d > want-time.Millisecond && d < want+time.Millisecond
+}
+
+func TestTokenBucketRate(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	b := newTokenBucket(50)
+	b.last, b.now, b.sleep = clock.now, clock.Now, clock.Sleep
+
+	for i := 0; i < 50; i++ {
+		b.wait()
+	}
+	if clock.slept != 0 {
+		t.Errorf("a burst of 50 waited %s", clock.slept)
+	}
+
+	for i := 0; i < 25; i++ {
+		b.wait()
+	}
+	if !withinMs(clock.slept, 500*time.Millisecond) {
+		t.Errorf("25 requests past the burst waited %s, want 500ms at 50 a second", clock.slept)
+	}
+
+	// A quiet spell refills the bucket, but only to one burst.
+	clock.now = clock.now.Add(time.Minute)
+	clock.slept = 0
+	for i := 0; i < 50; i++ {
+		b.wait()
+	}
+	if clock.slept != 0 {
+		t.Errorf("a burst after a quiet spell waited %s", clock.slept)
+	}
+	b.wait()
+	if !withinMs(clock.slept, 20*time.Millisecond) {
+		t.Errorf("the request after the burst waited %s, want 20ms", clock.slept)
+	}
+}
+
+// failingServer fails the first failures requests it gets with status and
+// body, then answers with a successful Last.fm response.
+func failingServer(failures, status int, body string) (*httptest.Server, *int) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+			return
+		}
+		fmt.Fprint(w, `<lfm status="ok"></lfm>`)
+	}))
+	return srv, &requests
+}
+
+func lastFMFailure(code int) string {
+	return fmt.Sprintf(`<lfm status="failed"><error code="%d">failed</error></lfm>`, code)
+}
+
+func testClient() *Client {
+	c := newLastFMClient()
+	c.bucket = nil
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = 2 * time.Millisecond
+	return c
+}
+
+func get(c *Client, url string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(req)
+	return err
+}
+
+func TestClientRetries(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"500", http.StatusInternalServerError, ""},
+		{"503", http.StatusServiceUnavailable, ""},
+		{"429", http.StatusTooManyRequests, ""},
+		{"code 8", http.StatusOK, lastFMFailure(8)},
+		{"code 11", http.StatusOK, lastFMFailure(11)},
+		{"code 16", http.StatusServiceUnavailable, lastFMFailure(16)},
+		{"code 29", http.StatusOK, lastFMFailure(29)},
+	} {
+		srv, requests := failingServer(3, c.status, c.body)
+		if err := get(testClient(), srv.URL); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+		if *requests != 4 {
+			t.Errorf("%s: made %d requests, want 4", c.name, *requests)
+		}
+		srv.Close()
+	}
+}
+
+func TestClientGivesUp(t *testing.T) {
+	srv, requests := failingServer(100, http.StatusBadGateway, "")
+	defer srv.Close()
+
+	client := testClient()
+	err := get(client, srv.URL+"?api_key=secret")
+	var retry *RetryError
+	if !errors.As(err, &retry) || retry.Attempts != client.MaxRetries+1 {
+		t.Fatalf("err = %v, want a RetryError after %d attempts", err, client.MaxRetries+1)
+	}
+	if *requests != client.MaxRetries+1 {
+		t.Errorf("made %d requests, want %d", *requests, client.MaxRetries+1)
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("err = %v, want the last HTTPError", err)
+	}
+	if httpErr != nil && httpErr.URL != srv.URL {
+		t.Errorf("error URL %q keeps the query", httpErr.URL)
+	}
+	if !Temporary(err) {
+		t.Error("Temporary(RetryError) = false")
+	}
+}
+
+func TestClientDoesNotRetryOtherErrors(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"400", http.StatusBadRequest, ""},
+		{"403", http.StatusForbidden, lastFMFailure(10)},
+		{"404", http.StatusNotFound, ""},
+		{"code 6", http.StatusBadRequest, lastFMFailure(6)},
+	} {
+		srv, requests := failingServer(1, c.status, c.body)
+		err := get(testClient(), srv.URL)
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) || httpErr.StatusCode != c.status {
+			t.Errorf("%s: err = %v, want an HTTPError", c.name, err)
+		}
+		if *requests != 1 {
+			t.Errorf("%s: made %d requests, want 1", c.name, *requests)
+		}
+		srv.Close()
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{&RetryError{Attempts: 6, Err: errors.New("502")}, true},
+		{&LFMError{Code: 29}, true},
+		{&LFMError{Code: 16}, true},
+		{&LFMError{Code: 6, Message: "User not found"}, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{&HTTPError{StatusCode: http.StatusNotFound}, false},
+		{errors.New("unexpected"), false},
+	} {
+		if got := Temporary(c.err); got != c.want {
+			t.Errorf("Temporary(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package sources
+
+import "net/http"
+
+// UserAgent is sent with every request made by a Source.
+var UserAgent = "LocalFM"
+
+// FetchBody fetches a http response body for a specific url
+func FetchBody(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Do(req)
+}
+
+// Do sends req with DefaultClient.
+func Do(req *http.Request) (*http.Response, error) {
+	return DefaultClient.Do(req)
+}
@@ -0,0 +1,326 @@
+package sources
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadFile calls fn for every listen in the backup at path, in the order the
+// file stores them. The format is chosen by extension:
+//
+//	.csv            lastfm-to-csv dumps (artist, album, title, date) or a
+//	                CSV with a header row, such as localfm export writes
+//	.json           Last.fm user.getrecenttracks pages saved by backup
+//	                scripts, either a single page, an array of pages or an
+//	                array of tracks
+//	.jsonl, .ndjson one track per line as written by localfm export
+//
+// Rows without a usable date, such as a track that was playing when the
+// backup was made, are skipped.
+func ReadFile(path string, fn func(Listen) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return readCSV(f, fn)
+	case ".json":
+		return readLastFMJSON(f, fn)
+	case ".jsonl", ".ndjson":
+		return readJSONLines(f, fn)
+	}
+	return fmt.Errorf("%s: unknown backup format, expected .csv, .json or .jsonl", path)
+}
+
+// readCSV reads a CSV backup. A first row naming artist and title columns is
+// taken as a header; otherwise columns are artist, album, title and date as
+// lastfm-to-csv writes them.
+func readCSV(r io.Reader, fn func(Listen) error) error {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+
+	cols := map[string]int{"artist": 0, "album": 1, "title": 2, "date": 3}
+	first := true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first {
+			first = false
+			if header := csvColumns(rec); header != nil {
+				cols = header
+				continue
+			}
+		}
+
+		get := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[i])
+		}
+
+		date, ok := parseBackupDate(get("uts"), get("date"))
+		if !ok {
+			continue
+		}
+		duration, _ := strconv.Atoi(get("duration"))
+		loved, _ := strconv.ParseBool(get("loved"))
+		synthetic, _ := strconv.ParseBool(get("synthetic"))
+		err = fn(Listen{
+			Artist:        get("artist"),
+			Album:         get("album"),
+			Title:         get("title"),
+			Date:          date,
+			Source:        get("source"),
+			Duration:      duration,
+			ArtistMBID:    get("artist_mbid"),
+			ReleaseMBID:   get("release_mbid"),
+			RecordingMBID: get("recording_mbid"),
+			URL:           get("url"),
+			ImageURL:      get("image_url"),
+			Loved:         loved,
+			Synthetic:     synthetic,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// csvColumns maps column names to positions if rec is a header row.
+func csvColumns(rec []string) map[string]int {
+	cols := make(map[string]int)
+	for i, name := range rec {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	_, artist := cols["artist"]
+	_, title := cols["title"]
+	if !artist || !title {
+		return nil
+	}
+	return cols
+}
+
+// parseBackupDate reads a unix timestamp if there is one, falling back to
+// the date formats backups are known to use.
+func parseBackupDate(uts, date string) (time.Time, bool) {
+	if uts != "" {
+		if n, err := strconv.ParseInt(uts, 10, 64); err == nil && n > 0 {
+			return time.Unix(n, 0).UTC(), true
+		}
+	}
+	for _, layout := range []string{
+		"02 Jan 2006 15:04",
+		"02 Jan 2006, 15:04",
+		time.RFC3339,
+		"2006-01-02 15:04:05",
+	} {
+		if t, err := time.Parse(layout, date); err == nil && !t.IsZero() {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// readJSONLines reads one exported track object per line.
+func readJSONLines(r io.Reader, fn func(Listen) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var t struct {
+			Artist        string    `json:"artist"`
+			Album         string    `json:"album"`
+			Title         string    `json:"title"`
+			Date          time.Time `json:"date"`
+			Source        string    `json:"source"`
+			Duration      int       `json:"duration"`
+			ArtistMBID    string    `json:"artist_mbid"`
+			ReleaseMBID   string    `json:"release_mbid"`
+			RecordingMBID string    `json:"recording_mbid"`
+			URL           string    `json:"url"`
+			ImageURL      string    `json:"image_url"`
+			Loved         bool      `json:"loved"`
+			Synthetic     bool      `json:"synthetic"`
+		}
+		err := dec.Decode(&t)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if t.Date.IsZero() {
+			continue
+		}
+		err = fn(Listen{
+			Artist:        t.Artist,
+			Album:         t.Album,
+			Title:         t.Title,
+			Date:          t.Date.UTC(),
+			Source:        t.Source,
+			Duration:      t.Duration,
+			ArtistMBID:    t.ArtistMBID,
+			ReleaseMBID:   t.ReleaseMBID,
+			RecordingMBID: t.RecordingMBID,
+			URL:           t.URL,
+			ImageURL:      t.ImageURL,
+			Loved:         t.Loved,
+			Synthetic:     t.Synthetic,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// jsonText is a Last.fm JSON value that is either a plain string or an
+// object holding the string in "#text" (or "name" for extended artists)
+// alongside an MBID.
+type jsonText struct {
+	Text string
+	MBID string
+}
+
+func (t *jsonText) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &t.Text)
+	}
+	var v struct {
+		Text string `json:"#text"`
+		Name string `json:"name"`
+		MBID string `json:"mbid"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	t.Text, t.MBID = v.Text, v.MBID
+	if t.Text == "" {
+		t.Text = v.Name
+	}
+	return nil
+}
+
+type jsonDate struct {
+	UTS  string `json:"uts"`
+	Text string `json:"#text"`
+}
+
+type jsonTrack struct {
+	Artist jsonText   `json:"artist"`
+	Album  jsonText   `json:"album"`
+	Name   string     `json:"name"`
+	MBID   string     `json:"mbid"`
+	URL    string     `json:"url"`
+	Images []jsonText `json:"image"`
+	Loved  string     `json:"loved"`
+	Date   jsonDate   `json:"date"`
+}
+
+type jsonPage struct {
+	RecentTracks *struct {
+		Track []jsonTrack `json:"track"`
+	} `json:"recenttracks"`
+}
+
+// readLastFMJSON reads saved user.getrecenttracks responses. Arrays are
+// decoded one element at a time so large backups are not held in memory.
+func readLastFMJSON(r io.Reader, fn func(Listen) error) error {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.ReadByte()
+	}
+
+	dec := json.NewDecoder(br)
+	if b, _ := br.Peek(1); b[0] != '[' {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		return readJSONElement(raw, fn)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		if err := readJSONElement(raw, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readJSONElement reads either a page of tracks or a single track.
+func readJSONElement(raw json.RawMessage, fn func(Listen) error) error {
+	var page jsonPage
+	if err := json.Unmarshal(raw, &page); err != nil {
+		return err
+	}
+	if page.RecentTracks != nil {
+		for _, t := range page.RecentTracks.Track {
+			if err := t.send(fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var t jsonTrack
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return err
+	}
+	return t.send(fn)
+}
+
+// send passes t to fn unless it has no date.
+func (t jsonTrack) send(fn func(Listen) error) error {
+	date, ok := parseBackupDate(t.Date.UTS, t.Date.Text)
+	if !ok {
+		return nil
+	}
+	var image string
+	for _, i := range t.Images {
+		if i.Text != "" {
+			image = i.Text
+		}
+	}
+	return fn(Listen{
+		Artist:        t.Artist.Text,
+		Album:         t.Album.Text,
+		Title:         t.Name,
+		Date:          date,
+		ArtistMBID:    t.Artist.MBID,
+		ReleaseMBID:   t.Album.MBID,
+		RecordingMBID: t.MBID,
+		URL:           t.URL,
+		ImageURL:      image,
+		Loved:         t.Loved == "1",
+	})
+}
@@ -0,0 +1,328 @@
+package sources
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LastFMURL is the root of the Last.fm 2.0 API.
+const LastFMURL = "http://ws.audioscrobbler.com/2.0/"
+
+var limit = 150
+
+// LastFMClient is shared by everything that calls the Last.fm API, so
+// together they stay within its limit of 5 requests a second.
+var LastFMClient = newLastFMClient()
+
+func newLastFMClient() *Client {
+	c := NewClient(5)
+	c.Retry = func(status int, body []byte) bool {
+		return retryableStatus(status, body) || retryableLastFMCode[lastFMErrorCode(body)]
+	}
+	return c
+}
+
+// LFMError is an error reported by the Last.fm API in place of a result.
+// It matches ErrInvalidAPIKey, ErrUserNotFound, ErrInvalidParameters,
+// ErrRateLimited and ErrServiceOffline with errors.Is according to its code.
+type LFMError struct {
+	Code    int    `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+// Errors reported by the Last.fm API that need the user's attention.
+var (
+	ErrInvalidAPIKey     = errors.New("invalid API key")
+	ErrUserNotFound      = errors.New("user not found")
+	ErrInvalidParameters = errors.New("invalid parameters")
+	ErrRateLimited       = errors.New("rate limit exceeded")
+	ErrServiceOffline    = errors.New("service offline")
+)
+
+// lastFMErrors maps Last.fm error codes to the errors above. 26 is a
+// suspended API key. Code 6, invalid parameters, is also what
+// user.getrecenttracks returns for an unknown user, which only its message
+// tells apart.
+var lastFMErrors = map[int]error{
+	6:  ErrInvalidParameters,
+	10: ErrInvalidAPIKey,
+	26: ErrInvalidAPIKey,
+	11: ErrServiceOffline,
+	16: ErrServiceOffline,
+	29: ErrRateLimited,
+}
+
+// retryableLastFMCode are the Last.fm error codes for failures that pass:
+// 8 operation failed, 11 service offline, 16 temporarily unavailable and 29
+// rate limit exceeded.
+var retryableLastFMCode = map[int]bool{8: true, 11: true, 16: true, 29: true}
+
+func (e *LFMError) Error() string {
+	return fmt.Sprintf("last.fm error %d: %s", e.Code, strings.TrimSpace(e.Message))
+}
+
+// Is reports whether target is the error e's code maps to.
+func (e *LFMError) Is(target error) bool {
+	if e.Code == 6 && strings.Contains(strings.ToLower(e.Message), "user not found") {
+		return target == ErrUserNotFound
+	}
+	return lastFMErrors[e.Code] == target
+}
+
+// Temporary reports whether the request may succeed if made again later.
+func (e *LFMError) Temporary() bool {
+	return retryableLastFMCode[e.Code]
+}
+
+// LastFMError returns the error in a failed Last.fm response, or nil if body
+// is not one.
+func LastFMError(body []byte) *LFMError {
+	var l LFM
+	if xml.Unmarshal(body, &l) != nil || l.Status != "failed" || l.Error == nil {
+		return nil
+	}
+	return l.Error
+}
+
+// lastFMErrorCode returns the code of the error in a failed Last.fm
+// response, or 0 if body is not one.
+func lastFMErrorCode(body []byte) int {
+	if e := LastFMError(body); e != nil {
+		return e.Code
+	}
+	return 0
+}
+
+type LFM struct {
+	XMLName      xml.Name     `xml:"lfm"`
+	Status       string       `xml:"status,attr"`
+	Error        *LFMError    `xml:"error"`
+	RecentTracks RecentTracks `xml:"recenttracks"`
+}
+type RecentTracks struct {
+	XMLName    xml.Name `xml:"recenttracks"`
+	User       string   `xml:"user,attr"`
+	Page       int      `xml:"page,attr"`
+	PerPage    int      `xml:"perPage,attr"`
+	TotalPages int      `xml:"totalPages,attr"`
+	Total      int      `xml:"total,attr"`
+	Tracks     []Track  `xml:"track"`
+}
+
+type Track struct {
+	XMLName    xml.Name    `xml:"track"`
+	Artist     TrackArtist `xml:"artist"`
+	Album      TrackAlbum  `xml:"album"`
+	Name       string      `xml:"name"`
+	MBID       string      `xml:"mbid"`
+	URL        string      `xml:"url"`
+	Images     []Image     `xml:"image"`
+	Loved      string      `xml:"loved"`
+	Date       Date        `xml:"date"`
+	NowPlaying bool        `xml:"nowplaying,attr"`
+}
+
+// TrackArtist is a track's artist. Plain responses give the name as text
+// with the MBID as an attribute; extended responses nest both as elements.
+type TrackArtist struct {
+	Text     string `xml:",chardata"`
+	MBIDAttr string `xml:"mbid,attr"`
+	Name     string `xml:"name"`
+	MBIDElem string `xml:"mbid"`
+}
+
+// String returns the artist's name.
+func (a TrackArtist) String() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return strings.TrimSpace(a.Text)
+}
+
+// MBID returns the artist's MusicBrainz ID.
+func (a TrackArtist) MBID() string {
+	if a.MBIDElem != "" {
+		return a.MBIDElem
+	}
+	return a.MBIDAttr
+}
+
+// TrackAlbum is a track's album and its MusicBrainz release ID.
+type TrackAlbum struct {
+	Text string `xml:",chardata"`
+	MBID string `xml:"mbid,attr"`
+}
+
+// Image is album art in one of several sizes.
+type Image struct {
+	Size string `xml:"size,attr"`
+	URL  string `xml:",chardata"`
+}
+
+// imageURL returns the largest image of a track. Last.fm lists images from
+// smallest to largest.
+func (t Track) imageURL() string {
+	for i := len(t.Images) - 1; i >= 0; i-- {
+		if t.Images[i].URL != "" {
+			return t.Images[i].URL
+		}
+	}
+	return ""
+}
+
+// Date is when a track was scrobbled. UTS is the exact Unix time; Text is
+// the same time for display, to the minute.
+type Date struct {
+	UTS  int64  `xml:"uts,attr"`
+	Text string `xml:",chardata"`
+}
+
+// Time returns the scrobble time in UTC, falling back to parsing Text when
+// the server did not send a timestamp.
+func (d Date) Time() (time.Time, error) {
+	if d.UTS > 0 {
+		return time.Unix(d.UTS, 0).UTC(), nil
+	}
+	return time.Parse("02 Jan 2006, 15:04", d.Text)
+}
+
+// LastFM reads listens from the user.getrecenttracks Last.fm API method. Any
+// server speaking the Last.fm 2.0 API, such as Libre.fm or a GNU FM instance,
+// can be used by pointing URL at its API root.
+type LastFM struct {
+	URL      string
+	Username string
+	APIKey   string
+}
+
+// NewLastFM returns a Source for user's scrobbles on the Last.fm compatible
+// API at root, or on Last.fm itself when root is empty.
+func NewLastFM(root, user, apiKey string) *LastFM {
+	if root == "" {
+		root = LastFMURL
+	}
+	return &LastFM{
+		URL:      strings.TrimRight(root, "/") + "/",
+		Username: user,
+		APIKey:   apiKey,
+	}
+}
+
+// Name returns "lastfm".
+func (s *LastFM) Name() string {
+	return "lastfm"
+}
+
+// Endpoint returns the API root.
+func (s *LastFM) Endpoint() string {
+	return s.URL
+}
+
+// Limit returns the number of tracks requested per page.
+func (s *LastFM) Limit() int {
+	return limit
+}
+
+// ConcurrentPages returns true: each page is a request of its own.
+func (s *LastFM) ConcurrentPages() bool {
+	return true
+}
+
+// Totals returns the number of pages and scrobbles made after since.
+func (s *LastFM) Totals(since int64) (pages, total int, err error) {
+	l, err := s.fetch(1, since)
+	if err != nil {
+		return 0, 0, err
+	}
+	return l.RecentTracks.TotalPages, l.RecentTracks.Total, nil
+}
+
+// Page returns the scrobbles on page, oldest first. The track being played
+// right now and tracks with unreadable dates are skipped.
+func (s *LastFM) Page(page int, since int64) ([]Listen, error) {
+	l, err := s.fetch(page, since)
+	if err != nil {
+		return nil, err
+	}
+
+	var listens []Listen
+	totalItems := (len(l.RecentTracks.Tracks) - 1)
+	for i := totalItems; i >= 0; i-- {
+		t := l.RecentTracks.Tracks[i]
+		if t.NowPlaying {
+			continue
+		}
+		dt, err := t.Date.Time()
+		if err != nil {
+			log.Printf("Error parsing time on %s / %s - %s / %s: %s\n", t.Artist, t.Album.Text, t.Name, t.Date.Text, err)
+			continue
+		}
+		if dt.IsZero() {
+			log.Println("Time is Zero")
+			continue
+		}
+		listens = append(listens, Listen{
+			Artist:        t.Artist.String(),
+			Album:         t.Album.Text,
+			Title:         t.Name,
+			Date:          dt,
+			ArtistMBID:    t.Artist.MBID(),
+			ReleaseMBID:   t.Album.MBID,
+			RecordingMBID: t.MBID,
+			URL:           t.URL,
+			ImageURL:      t.imageURL(),
+			Loved:         t.Loved == "1",
+		})
+	}
+	return listens, nil
+}
+
+// fetch fetches and decodes a single page of recent tracks.
+func (s *LastFM) fetch(page int, since int64) (l LFM, err error) {
+	q := url.Values{}
+	q.Set("method", "user.getrecenttracks")
+	q.Set("api_key", s.APIKey)
+	q.Set("user", s.Username)
+	q.Set("page", fmt.Sprint(page))
+	q.Set("limit", fmt.Sprint(limit))
+	q.Set("extended", "1")
+	if since != 0 {
+		q.Set("from", fmt.Sprint(since))
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"?"+q.Encode(), nil)
+	if err != nil {
+		return l, err
+	}
+	resp, err := LastFMClient.Do(req)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		if e := LastFMError(httpErr.Body); e != nil {
+			return l, e
+		}
+	}
+	if err != nil {
+		return l, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return l, err
+	}
+
+	if err := xml.Unmarshal(body, &l); err != nil {
+		return l, err
+	}
+	if l.Status == "failed" && l.Error != nil {
+		return l, l.Error
+	}
+	return l, nil
+}
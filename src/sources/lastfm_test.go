@@ -0,0 +1,25 @@
+package sources
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLFMErrorIs(t *testing.T) {
+	for _, c := range []struct {
+		err  *LFMError
+		want error
+	}{
+		{&LFMError{Code: 6, Message: "User not found"}, ErrUserNotFound},
+		{&LFMError{Code: 6, Message: "Invalid parameters - Your request is missing a required parameter"}, ErrInvalidParameters},
+		{&LFMError{Code: 10, Message: "Invalid API key"}, ErrInvalidAPIKey},
+		{&LFMError{Code: 29, Message: "Rate limit exceeded"}, ErrRateLimited},
+		{&LFMError{Code: 16, Message: "There was a temporary error"}, ErrServiceOffline},
+	} {
+		for _, target := range []error{ErrInvalidAPIKey, ErrUserNotFound, ErrInvalidParameters, ErrRateLimited, ErrServiceOffline} {
+			if got := errors.Is(c.err, target); got != (target == c.want) {
+				t.Errorf("errors.Is(%v, %v) = %v", c.err, target, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package sources
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListenBrainzURL is the root of the public ListenBrainz API.
+const ListenBrainzURL = "https://api.listenbrainz.org"
+
+const listenBrainzLimit = 100
+
+type lbListens struct {
+	Payload struct {
+		Count   int        `json:"count"`
+		Listens []lbListen `json:"listens"`
+	} `json:"payload"`
+}
+
+type lbListen struct {
+	ListenedAt    int64 `json:"listened_at"`
+	TrackMetadata struct {
+		ArtistName  string `json:"artist_name"`
+		ReleaseName string `json:"release_name"`
+		TrackName   string `json:"track_name"`
+	} `json:"track_metadata"`
+}
+
+type lbCount struct {
+	Payload struct {
+		Count int `json:"count"`
+	} `json:"payload"`
+}
+
+type lbError struct {
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+// ListenBrainz reads listens from the ListenBrainz /1/user/{name}/listens API.
+//
+// The API pages with timestamps rather than page numbers. Listens are read
+// oldest first by passing the newest timestamp read so far as min_ts, so
+// walking the pages from the last down to 1, as imports do, reads each
+// listen once. A full import takes its total from the listen-count endpoint;
+// when since is set, Totals reads the listens made after it, which are few,
+// and Page serves them from memory. Calls are serialised, as they share the
+// position read to.
+type ListenBrainz struct {
+	URL      string
+	Username string
+	Token    string
+
+	mu    sync.Mutex
+	since int64
+	ready bool
+	total int
+	delta []lbListen
+
+	// pos is how many listens, oldest first, have been read. lastTs is the
+	// newest timestamp read and seen the listens read at that second, which
+	// the next request asks for again so none sharing it are missed.
+	pos    int
+	lastTs int64
+	seen   map[lbKey]bool
+}
+
+// lbMaxCount is the most listens the API returns for one request.
+const lbMaxCount = 1000
+
+type lbKey struct {
+	ts            int64
+	artist, title string
+}
+
+// NewListenBrainz returns a Source for username's listens on the ListenBrainz
+// server at root. The token is optional and only needed for private listens.
+func NewListenBrainz(root, username, token string) *ListenBrainz {
+	if root == "" {
+		root = ListenBrainzURL
+	}
+	return &ListenBrainz{
+		URL:      strings.TrimRight(root, "/"),
+		Username: username,
+		Token:    token,
+	}
+}
+
+// Name returns "listenbrainz".
+func (s *ListenBrainz) Name() string {
+	return "listenbrainz"
+}
+
+// Endpoint returns the API root.
+func (s *ListenBrainz) Endpoint() string {
+	return s.URL
+}
+
+// Limit returns the number of listens requested per page.
+func (s *ListenBrainz) Limit() int {
+	return listenBrainzLimit
+}
+
+// Totals returns the number of pages and listens made after since.
+func (s *ListenBrainz) Totals(since int64) (pages, total int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totals(since)
+}
+
+func (s *ListenBrainz) totals(since int64) (pages, total int, err error) {
+	s.ready, s.since, s.delta = false, since, nil
+	s.rewind()
+
+	if since == 0 {
+		var c lbCount
+		if err := s.get("listen-count", nil, &c); err != nil {
+			return 0, 0, err
+		}
+		s.total = c.Payload.Count
+	} else {
+		for {
+			l, done, err := s.next(lbMaxCount / 2)
+			if err != nil {
+				return 0, 0, err
+			}
+			s.delta = append(s.delta, l...)
+			if done {
+				break
+			}
+		}
+		s.total = len(s.delta)
+	}
+
+	s.ready = true
+	return (s.total + listenBrainzLimit - 1) / listenBrainzLimit, s.total, nil
+}
+
+// Page returns the listens on page, oldest first. Reading the pages in
+// descending order continues from where the last one stopped; jumping to
+// another page, as resuming an import does, walks forward to it first.
+func (s *ListenBrainz) Page(page int, since int64) ([]Listen, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.ready || s.since != since {
+		if _, _, err := s.totals(since); err != nil {
+			return nil, err
+		}
+	}
+	if page < 1 || page > (s.total+listenBrainzLimit-1)/listenBrainzLimit {
+		return nil, nil
+	}
+	start := s.total - page*listenBrainzLimit
+	end := start + listenBrainzLimit
+	if start < 0 {
+		start = 0
+	}
+
+	var l []lbListen
+	if since != 0 {
+		l = s.delta[start:end]
+	} else {
+		if start < s.pos {
+			s.rewind()
+		}
+		for s.pos < start {
+			n := start - s.pos
+			if n > lbMaxCount/2 {
+				n = lbMaxCount / 2
+			}
+			if _, done, err := s.next(n); err != nil {
+				return nil, err
+			} else if done && s.pos < start {
+				return nil, nil
+			}
+		}
+		var err error
+		if l, _, err = s.next(end - start); err != nil {
+			return nil, err
+		}
+	}
+
+	listens := make([]Listen, 0, len(l))
+	for _, x := range l {
+		m := x.TrackMetadata
+		listens = append(listens, Listen{
+			Artist: m.ArtistName,
+			Album:  m.ReleaseName,
+			Title:  m.TrackName,
+			Date:   time.Unix(x.ListenedAt, 0).UTC(),
+		})
+	}
+	return listens, nil
+}
+
+// rewind goes back to the oldest listen after since.
+func (s *ListenBrainz) rewind() {
+	s.pos, s.lastTs, s.seen = 0, s.since, nil
+}
+
+// next reads up to count listens after the ones already read, oldest first,
+// reporting whether there are no more. Listens at the second the last read
+// stopped at are requested again and those already read dropped.
+func (s *ListenBrainz) next(count int) (listens []lbListen, done bool, err error) {
+	minTs := s.lastTs - 1
+	if minTs < 0 {
+		minTs = 0
+	}
+	requested := count + len(s.seen)
+	q := url.Values{}
+	q.Set("min_ts", fmt.Sprint(minTs))
+	q.Set("count", fmt.Sprint(requested))
+
+	var l lbListens
+	if err := s.get("listens", q, &l); err != nil {
+		return nil, false, err
+	}
+	got := l.Payload.Listens
+
+	// The API returns the listens nearest min_ts, newest first.
+	for i := len(got) - 1; i >= 0 && len(listens) < count; i-- {
+		x := got[i]
+		k := lbKey{x.ListenedAt, x.TrackMetadata.ArtistName, x.TrackMetadata.TrackName}
+		if x.ListenedAt == s.lastTs && s.seen[k] {
+			continue
+		}
+		if x.ListenedAt != s.lastTs || s.seen == nil {
+			s.lastTs, s.seen = x.ListenedAt, make(map[lbKey]bool)
+		}
+		s.seen[k] = true
+		listens = append(listens, x)
+	}
+	s.pos += len(listens)
+	return listens, len(got) < requested || len(listens) == 0, nil
+}
+
+// get requests path under the user's API root and decodes the response
+// into v.
+func (s *ListenBrainz) get(path string, q url.Values, v interface{}) error {
+	u := fmt.Sprintf("%s/1/user/%s/%s", s.URL, url.PathEscape(s.Username), path)
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.Token)
+	}
+
+	resp, err := Do(req)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		var e lbError
+		json.Unmarshal(httpErr.Body, &e)
+		if e.Error == "" {
+			e.Error = httpErr.Status
+		}
+		return fmt.Errorf("listenbrainz: %s", e.Error)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
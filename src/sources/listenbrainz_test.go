@@ -0,0 +1,245 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeListenBrainz serves listens the way the ListenBrainz API does: with
+// min_ts alone the oldest count listens after it, otherwise the newest
+// before max_ts, always newest first.
+type fakeListenBrainz struct {
+	listens []lbListen // oldest first
+	token   string
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newFakeListenBrainz(n int) *fakeListenBrainz {
+	f := &fakeListenBrainz{}
+	for i := 0; i < n; i++ {
+		var l lbListen
+		// Three listens share each second, so page boundaries fall inside
+		// a second.
+		l.ListenedAt = 1500000000 + int64(i/3)
+		l.TrackMetadata.ArtistName = "Artist"
+		l.TrackMetadata.TrackName = fmt.Sprintf("Track %d", i)
+		f.listens = append(f.listens, l)
+	}
+	return f
+}
+
+func (f *fakeListenBrainz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+	f.mu.Unlock()
+	if f.token != "" && r.Header.Get("Authorization") != "Token "+f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(lbError{Code: 401, Error: "Invalid authorization token."})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/1/user/alice/listen-count":
+		fmt.Fprintf(w, `{"payload":{"count":%d}}`, len(f.listens))
+	case "/1/user/alice/listens":
+		q := r.URL.Query()
+		count, _ := strconv.Atoi(q.Get("count"))
+		var page []lbListen
+		if minTs, err := strconv.ParseInt(q.Get("min_ts"), 10, 64); err == nil && q.Get("max_ts") == "" {
+			for _, l := range f.listens {
+				if l.ListenedAt > minTs && len(page) < count {
+					page = append(page, l)
+				}
+			}
+		} else {
+			maxTs, err := strconv.ParseInt(q.Get("max_ts"), 10, 64)
+			for i := len(f.listens) - 1; i >= 0 && len(page) < count; i-- {
+				if err != nil || f.listens[i].ListenedAt < maxTs {
+					page = append([]lbListen{f.listens[i]}, page...)
+				}
+			}
+		}
+		for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+			page[i], page[j] = page[j], page[i]
+		}
+
+		var resp lbListens
+		resp.Payload.Count = len(page)
+		resp.Payload.Listens = page
+		json.NewEncoder(w).Encode(resp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeListenBrainz) listenRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, "/1/user/alice/listens") {
+			n++
+		}
+	}
+	return n
+}
+
+func readAllPages(t *testing.T, s Source, since int64) []Listen {
+	pages, _, err := s.Totals(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []Listen
+	for i := pages; i >= 1; i-- {
+		l, err := s.Page(i, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, l...)
+	}
+	return all
+}
+
+func TestListenBrainzPagesReadEachListenOnce(t *testing.T) {
+	fake := newFakeListenBrainz(250)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := NewListenBrainz(srv.URL, "alice", "")
+	pages, total, err := s.Totals(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 3 || total != 250 {
+		t.Fatalf("Totals = %d pages, %d listens, want 3 and 250", pages, total)
+	}
+
+	all := readAllPages(t, s, 0)
+	if len(all) != 250 {
+		t.Fatalf("read %d listens, want 250", len(all))
+	}
+	for i, l := range all {
+		if want := fmt.Sprintf("Track %d", i); l.Title != want {
+			t.Fatalf("listen %d is %q, want %q", i, l.Title, want)
+		}
+	}
+	if n := fake.listenRequests(); n != 3 {
+		t.Errorf("made %d listens requests for 3 pages", n)
+	}
+}
+
+func TestListenBrainzPageSizes(t *testing.T) {
+	srv := httptest.NewServer(newFakeListenBrainz(250))
+	defer srv.Close()
+
+	s := NewListenBrainz(srv.URL, "alice", "")
+	if _, _, err := s.Totals(0); err != nil {
+		t.Fatal(err)
+	}
+	// Page 1 holds the newest listens, as with Last.fm, so resuming an
+	// import at a page number continues where it stopped.
+	for _, c := range []struct{ page, size, first int }{{2, 100, 50}, {1, 100, 150}, {3, 50, 0}, {4, 0, 0}} {
+		l, err := s.Page(c.page, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(l) != c.size {
+			t.Fatalf("page %d has %d listens, want %d", c.page, len(l), c.size)
+		}
+		if c.size > 0 && l[0].Title != fmt.Sprintf("Track %d", c.first) {
+			t.Errorf("page %d starts with %q, want Track %d", c.page, l[0].Title, c.first)
+		}
+	}
+}
+
+func TestListenBrainzSince(t *testing.T) {
+	fake := newFakeListenBrainz(250)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	since := fake.listens[200].ListenedAt
+	all := readAllPages(t, NewListenBrainz(srv.URL, "alice", ""), since)
+
+	var want []string
+	for _, l := range fake.listens {
+		if l.ListenedAt >= since {
+			want = append(want, l.TrackMetadata.TrackName)
+		}
+	}
+	if len(all) != len(want) {
+		t.Fatalf("read %d listens, want %d", len(all), len(want))
+	}
+	for i := range all {
+		if all[i].Title != want[i] {
+			t.Fatalf("listen %d is %q, want %q", i, all[i].Title, want[i])
+		}
+	}
+	for _, r := range fake.requests {
+		if !strings.Contains(r, "min_ts=") {
+			t.Errorf("request %s does not send min_ts", r)
+		}
+	}
+}
+
+func TestListenBrainzToken(t *testing.T) {
+	fake := newFakeListenBrainz(10)
+	fake.token = "secret"
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	_, _, err := NewListenBrainz(srv.URL, "alice", "wrong").Totals(0)
+	if err == nil || !strings.Contains(err.Error(), "Invalid authorization token") {
+		t.Errorf("Totals with a wrong token = %v, want the API's error", err)
+	}
+
+	if all := readAllPages(t, NewListenBrainz(srv.URL, "alice", "secret"), 0); len(all) != 10 {
+		t.Errorf("read %d listens with the token, want 10", len(all))
+	}
+}
+
+func TestListenBrainzConcurrentPages(t *testing.T) {
+	srv := httptest.NewServer(newFakeListenBrainz(1000))
+	defer srv.Close()
+
+	s := NewListenBrainz(srv.URL, "alice", "")
+	pages, _, err := s.Totals(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([][]Listen, pages+1)
+	var wg sync.WaitGroup
+	for i := pages; i >= 1; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, err := s.Page(i, 0)
+			if err != nil {
+				t.Error(err)
+			}
+			got[i] = l
+		}(i)
+	}
+	wg.Wait()
+
+	n := 0
+	for i := pages; i >= 1; i-- {
+		for _, l := range got[i] {
+			if want := fmt.Sprintf("Track %d", n); l.Title != want {
+				t.Fatalf("listen %d is %q, want %q", n, l.Title, want)
+			}
+			n++
+		}
+	}
+	if n != 1000 {
+		t.Errorf("read %d listens, want 1000", n)
+	}
+}
@@ -0,0 +1,81 @@
+package sources
+
+import "time"
+
+// DefaultMinPlayed is the longest a track has to be played to count as a
+// scrobble, whatever its length.
+const DefaultMinPlayed = 4 * time.Minute
+
+// minTrackLength is the shortest track Last.fm accepts scrobbles for.
+const minTrackLength = 30 * time.Second
+
+// Listen is a single play reported by a Source. Source, Duration and the
+// MusicBrainz IDs are only set when known; Source names where a listen read
+// from a backup was originally recorded. URL links to the track's page and
+// ImageURL to its album art. Synthetic marks a listen whose Date was made up
+// from a play count.
+type Listen struct {
+	Artist        string
+	Album         string
+	Title         string
+	Date          time.Time
+	Source        string
+	Duration      int
+	ArtistMBID    string
+	ReleaseMBID   string
+	RecordingMBID string
+	URL           string
+	ImageURL      string
+	Loved         bool
+	Synthetic     bool
+}
+
+// Source is a service that listens can be imported from. Pages are numbered
+// from 1 with the newest listens first, so walking from the last page down to
+// page 1 returns listens in the order they were made. A Source need not be
+// safe to use from several goroutines at once unless it is a
+// ConcurrentSource.
+type Source interface {
+	// Name identifies the source, e.g. "lastfm".
+	Name() string
+	// Endpoint identifies the server listens are read from. It is stored
+	// with every imported track.
+	Endpoint() string
+	// Limit returns the number of listens on a full page.
+	Limit() int
+	// Totals returns the number of pages and listens made after since.
+	Totals(since int64) (pages, total int, err error)
+	// Page returns the listens on page made after since, oldest first.
+	Page(page int, since int64) ([]Listen, error)
+}
+
+// ConcurrentSource is a Source whose pages can be fetched in parallel.
+type ConcurrentSource interface {
+	Source
+	// ConcurrentPages reports whether Page may be called from several
+	// goroutines at once.
+	ConcurrentPages() bool
+}
+
+// Concurrent reports whether s's pages can be fetched in parallel.
+func Concurrent(s Source) bool {
+	c, ok := s.(ConcurrentSource)
+	return ok && c.ConcurrentPages()
+}
+
+// Scrobbled applies the Last.fm scrobble rule to a play of a track of the
+// given length: it counts once half the track or minPlayed has been heard,
+// whichever comes first. Tracks under 30 seconds never count. A zero length
+// means it is unknown, and the play must last minPlayed.
+func Scrobbled(played, length, minPlayed time.Duration) bool {
+	need := minPlayed
+	if length > 0 {
+		if length < minTrackLength {
+			return false
+		}
+		if length/2 < need {
+			need = length / 2
+		}
+	}
+	return played >= need
+}
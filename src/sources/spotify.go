@@ -0,0 +1,140 @@
+package sources
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SpotifySource is stored with every track imported from Spotify.
+const SpotifySource = "spotify"
+
+// spotifyPlay is one entry of Spotify's Extended Streaming History. Ts is
+// when playback stopped. Podcast episodes have no track name.
+type spotifyPlay struct {
+	Ts        time.Time `json:"ts"`
+	MsPlayed  int64     `json:"ms_played"`
+	Track     *string   `json:"master_metadata_track_name"`
+	Artist    *string   `json:"master_metadata_album_artist_name"`
+	Album     *string   `json:"master_metadata_album_album_name"`
+	URI       *string   `json:"spotify_track_uri"`
+	ReasonEnd string    `json:"reason_end"`
+}
+
+// SpotifyHistory reads listens from the JSON files of a Spotify Extended
+// Streaming History export.
+type SpotifyHistory struct {
+	Files []string
+	// MinPlayed caps the scrobble rule: a play counts once half the track
+	// or MinPlayed has been heard, whichever is shorter.
+	MinPlayed time.Duration
+}
+
+// NewSpotifyHistory returns a SpotifyHistory for paths, which may name the
+// export's JSON files or the directory it was unpacked to. A zero minPlayed
+// uses DefaultMinPlayed.
+func NewSpotifyHistory(paths []string, minPlayed time.Duration) (*SpotifyHistory, error) {
+	if minPlayed <= 0 {
+		minPlayed = DefaultMinPlayed
+	}
+	h := &SpotifyHistory{MinPlayed: minPlayed}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			h.Files = append(h.Files, path)
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(path, "*Streaming_History_Audio_*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		h.Files = append(h.Files, files...)
+	}
+	return h, nil
+}
+
+// Each calls fn for every play that passes the scrobble rule. The export
+// does not include track lengths, so they are learnt from plays that ran to
+// the end of the track; a play of a track never heard to the end must last
+// MinPlayed. Listens are dated from when playback started.
+func (h *SpotifyHistory) Each(fn func(Listen) error) error {
+	lengths := make(map[string]time.Duration)
+	err := h.each(func(p spotifyPlay) error {
+		if p.ReasonEnd == "trackdone" && p.URI != nil {
+			if d := time.Duration(p.MsPlayed) * time.Millisecond; d > lengths[*p.URI] {
+				lengths[*p.URI] = d
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return h.each(func(p spotifyPlay) error {
+		played := time.Duration(p.MsPlayed) * time.Millisecond
+		var length time.Duration
+		if p.URI != nil {
+			length = lengths[*p.URI]
+		}
+		if !Scrobbled(played, length, h.MinPlayed) {
+			return nil
+		}
+
+		l := Listen{
+			Artist:   *p.Artist,
+			Title:    *p.Track,
+			Date:     p.Ts.Add(-played).Truncate(time.Second).UTC(),
+			Source:   SpotifySource,
+			Duration: int(length / time.Second),
+		}
+		if p.Album != nil {
+			l.Album = *p.Album
+		}
+		return fn(l)
+	})
+}
+
+// each decodes the plays in every file one at a time, skipping entries that
+// are not music.
+func (h *SpotifyHistory) each(fn func(spotifyPlay) error) error {
+	for _, path := range h.Files {
+		if err := readSpotifyFile(path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSpotifyFile(path string, fn func(spotifyPlay) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		var p spotifyPlay
+		if err := dec.Decode(&p); err != nil {
+			return err
+		}
+		if p.Track == nil || p.Artist == nil || p.Ts.IsZero() {
+			continue
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}